@@ -4,6 +4,8 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log/slog"
+	"os"
 	"time"
 
 	"github.com/basillica/go-statemachine/statemachine"
@@ -89,19 +91,19 @@ func ExampleMain() {
 		// Programmatic builder definition
 		mapBranchBuilder := statemachine.NewStateMachineBuilder().
 			StartAt("MapTask").
-			AddTask("MapTask", tasks["MapTask"], "MapEnd", true).
+			AddTask("MapTask", tasks["MapTask"], "MapEnd", statemachine.AsEnd()).
 			AddEnd("MapEnd")
 
 		mapBranch, _ := mapBranchBuilder.Build()
 
 		branchABuilder := statemachine.NewStateMachineBuilder().
 			StartAt("BranchATask").
-			AddTask("BranchATask", tasks["BranchATask"], "BranchAEnd", true).
+			AddTask("BranchATask", tasks["BranchATask"], "BranchAEnd", statemachine.AsEnd()).
 			AddEnd("BranchAEnd")
 
 		branchBBuilder := statemachine.NewStateMachineBuilder().
 			StartAt("BranchBTask").
-			AddTask("BranchBTask", tasks["BranchBTask"], "BranchBEnd", true).
+			AddTask("BranchBTask", tasks["BranchBTask"], "BranchBEnd", statemachine.AsEnd()).
 			AddEnd("BranchBEnd")
 
 		builder := statemachine.NewStateMachineBuilder().
@@ -113,11 +115,12 @@ func ExampleMain() {
 			AddMap("TestMapState", "items_to_process", "map_output", mapBranch, "TestChoiceState").
 			AddChoice("TestChoiceState", []statemachine.ChoiceRule{
 				{
-					Condition: map[string]any{"StringEquals": "go"},
+					Variable:  "$.choice_value",
+					Condition: statemachine.Condition{"StringEquals": "go"},
 					Next:      "TestParallelState",
 				},
 				{
-					Condition: map[string]any{"NumericEquals": float64(10)},
+					Condition: statemachine.NumericEquals("$.choice_value", 10),
 					Next:      "SucceedingTask",
 				},
 			}, "DefaultTask").
@@ -126,8 +129,8 @@ func ExampleMain() {
 			AddTask("TestRetryCatch", tasks["TestRetryCatch"], "FinalEnd",
 				statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", Interval: 50 * time.Millisecond, MaxAttempts: 3},
 				statemachine.CatchRule{ErrorName: "API_BAD_GATEWAY", NextState: "FailState"}).
-			AddTask("DefaultTask", tasks["DefaultTask"], "FinalEnd", true).
-			AddTask("SucceedingTask", tasks["SucceedingTask"], "FinalEnd", true).
+			AddTask("DefaultTask", tasks["DefaultTask"], "FinalEnd", statemachine.AsEnd()).
+			AddTask("SucceedingTask", tasks["SucceedingTask"], "FinalEnd", statemachine.AsEnd()).
 			AddFail("FailState").
 			AddEnd("FinalEnd")
 
@@ -139,8 +142,11 @@ func ExampleMain() {
 		fmt.Println("--- Running state machine from programmatic builder ---")
 	}
 
-	if err := sm.Run(context.Background(), map[string]any{}); err != nil {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	exec, err := sm.Run(context.Background(), map[string]any{}, statemachine.WithLogger(logger))
+	if err != nil {
 		fmt.Printf("Workflow failed: %v\n", err)
 	}
-	fmt.Printf("\nFinal context data: %+v\n", sm.Context.Data)
+	fmt.Printf("\nExecution %s finished with status %s\n", exec.ID, exec.Status())
+	fmt.Printf("Final context data: %+v\n", exec.Output())
 }
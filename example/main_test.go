@@ -1,8 +1,18 @@
 package example_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -63,21 +73,32 @@ var testTasks = map[string]statemachine.TaskFn{
 	},
 }
 
+// writeDefinition writes a JSON state machine definition to a temporary file
+// and returns its path, for ParseStateMachine.
+func writeDefinition(t *testing.T, definition string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "definition.json")
+	if err := os.WriteFile(path, []byte(definition), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
 // buildTestStateMachine is now a helper function to create a new, clean instance for each test.
 func buildTestStateMachine() *statemachine.StateMachine {
 	mapBranchBuilder := statemachine.NewStateMachineBuilder().
 		StartAt("MapTask").
-		AddTask("MapTask", testTasks["MapTask"], "MapEnd", true).
+		AddTask("MapTask", testTasks["MapTask"], "MapEnd", statemachine.AsEnd()).
 		AddEnd("MapEnd")
 	mapBranch, _ := mapBranchBuilder.Build()
 
 	branchABuilder := statemachine.NewStateMachineBuilder().
 		StartAt("BranchATask").
-		AddTask("BranchATask", testTasks["BranchATask"], "BranchAEnd", true).
+		AddTask("BranchATask", testTasks["BranchATask"], "BranchAEnd", statemachine.AsEnd()).
 		AddEnd("BranchAEnd")
 	branchBBuilder := statemachine.NewStateMachineBuilder().
 		StartAt("BranchBTask").
-		AddTask("BranchBTask", testTasks["BranchBTask"], "BranchBEnd", true).
+		AddTask("BranchBTask", testTasks["BranchBTask"], "BranchBEnd", statemachine.AsEnd()).
 		AddEnd("BranchBEnd")
 
 	builder := statemachine.NewStateMachineBuilder().
@@ -89,11 +110,12 @@ func buildTestStateMachine() *statemachine.StateMachine {
 		AddMap("TestMapState", "items_to_process", "map_output", mapBranch, "TestChoiceState").
 		AddChoice("TestChoiceState", []statemachine.ChoiceRule{
 			{
-				Condition: map[string]any{"StringEquals": "go"},
+				Variable:  "$.choice_value",
+				Condition: statemachine.Condition{"StringEquals": "go"},
 				Next:      "TestParallelState",
 			},
 			{
-				Condition: map[string]any{"NumericEquals": float64(10)},
+				Condition: statemachine.NumericEquals("$.choice_value", 10),
 				Next:      "SucceedingTask",
 			},
 		}, "DefaultTask").
@@ -102,8 +124,8 @@ func buildTestStateMachine() *statemachine.StateMachine {
 		AddTask("TestRetryCatch", testTasks["TestRetryCatch"], "FinalEnd",
 			statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", Interval: 50 * time.Millisecond, MaxAttempts: 3},
 			statemachine.CatchRule{ErrorName: "API_BAD_GATEWAY", NextState: "FailState"}).
-		AddTask("DefaultTask", testTasks["DefaultTask"], "FinalEnd", true).
-		AddTask("SucceedingTask", testTasks["SucceedingTask"], "FinalEnd", true).
+		AddTask("DefaultTask", testTasks["DefaultTask"], "FinalEnd", statemachine.AsEnd()).
+		AddTask("SucceedingTask", testTasks["SucceedingTask"], "FinalEnd", statemachine.AsEnd()).
 		AddFail("FailState").
 		AddEnd("FinalEnd")
 
@@ -114,13 +136,13 @@ func buildTestStateMachine() *statemachine.StateMachine {
 func TestProgrammaticStateMachine(t *testing.T) {
 	t.Run("Full workflow execution with expected failure (StringEquals path)", func(t *testing.T) {
 		sm := buildTestStateMachine()
-		err := sm.Run(context.Background(), map[string]any{})
+		exec, err := sm.Run(context.Background(), map[string]any{})
 		if err == nil {
 			t.Fatal("Expected workflow to fail, but it succeeded")
 		}
 
-		if sm.Context.Data["attempts"] != float64(4) {
-			t.Errorf("Expected 4 attempts, got %v", sm.Context.Data["attempts"])
+		if exec.Output()["attempts"] != float64(4) {
+			t.Errorf("Expected 4 attempts, got %v", exec.Output()["attempts"])
 		}
 	})
 
@@ -131,12 +153,12 @@ func TestProgrammaticStateMachine(t *testing.T) {
 			"choice_value":     "other",
 		}
 
-		err := sm.Run(context.Background(), initialData)
+		exec, err := sm.Run(context.Background(), initialData)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
 
-		if _, ok := sm.Context.Data["default_path"]; !ok {
+		if _, ok := exec.Output()["default_path"]; !ok {
 			t.Errorf("Expected 'default_path' to be in context, but it wasn't")
 		}
 	})
@@ -148,11 +170,11 @@ func TestProgrammaticStateMachine(t *testing.T) {
 			"choice_value":     float64(10),
 		}
 
-		err := sm.Run(context.Background(), initialData)
+		exec, err := sm.Run(context.Background(), initialData)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
-		if _, ok := sm.Context.Data["succeeding_path"]; !ok {
+		if _, ok := exec.Output()["succeeding_path"]; !ok {
 			t.Errorf("Expected 'succeeding_path' to be in context, but it wasn't")
 		}
 	})
@@ -161,13 +183,13 @@ func TestProgrammaticStateMachine(t *testing.T) {
 		sm := statemachine.NewStateMachineBuilder().
 			StartAt("TestTimeoutTask").
 			AddTask("TestTimeoutTask", testTasks["TestTimeoutTask"], "End",
-				1, // Set timeout to 1 second
+				statemachine.WithTimeout(time.Second),
 				statemachine.CatchRule{ErrorName: "TIMEOUT", NextState: "FailState"}).
 			AddFail("FailState").
 			AddEnd("End").
 			BuildOrDie()
 
-		err := sm.Run(context.Background(), map[string]any{})
+		exec, err := sm.Run(context.Background(), map[string]any{})
 
 		if err == nil {
 			t.Fatal("Expected workflow to fail due to timeout, but it succeeded.")
@@ -177,6 +199,62 @@ func TestProgrammaticStateMachine(t *testing.T) {
 		if err.Error() != expectedError {
 			t.Errorf("Expected error: %q, but got %q", expectedError, err.Error())
 		}
+		if exec.Status() != statemachine.ExecutionFailed {
+			t.Errorf("Expected status %s, got %s", statemachine.ExecutionFailed, exec.Status())
+		}
+	})
+
+	t.Run("Concurrent executions share one machine", func(t *testing.T) {
+		sm := buildTestStateMachine()
+		executions := make([]*statemachine.Execution, 5)
+		for i := range executions {
+			executions[i] = sm.Start(context.Background(), map[string]any{
+				"items_to_process": []any{i},
+				"choice_value":     "other",
+			})
+		}
+
+		for i, exec := range executions {
+			if err := exec.Wait(); err != nil {
+				t.Fatalf("Execution %d failed: %v", i, err)
+			}
+			if exec.Status() != statemachine.ExecutionSucceeded {
+				t.Errorf("Execution %d: expected status %s, got %s", i, statemachine.ExecutionSucceeded, exec.Status())
+			}
+			mapOutput, _ := exec.Output()["map_output"].([]any)
+			if len(mapOutput) != 1 || mapOutput[0].(map[string]any)["processed_item"] != float64(i*10) {
+				t.Errorf("Execution %d: unexpected map output %v", i, mapOutput)
+			}
+		}
+	})
+
+	t.Run("States run back to back", func(t *testing.T) {
+		builder := statemachine.NewStateMachineBuilder().StartAt("Step0")
+		for i := range 20 {
+			builder.AddPass(fmt.Sprintf("Step%d", i), fmt.Sprintf("Step%d", i+1), nil)
+		}
+		sm := builder.AddEnd("Step20").BuildOrDie()
+
+		start := time.Now()
+		if _, err := sm.Run(context.Background(), map[string]any{}); err != nil {
+			t.Fatalf("Expected the execution to succeed, got %v", err)
+		}
+		if took := time.Since(start); took > 500*time.Millisecond {
+			t.Errorf("Expected 20 Pass states to run without delay between them, took %v", took)
+		}
+	})
+
+	t.Run("Adding states after Build does not change the machine", func(t *testing.T) {
+		builder := statemachine.NewStateMachineBuilder().
+			StartAt("A").
+			AddPass("A", "B", nil).
+			AddEnd("B")
+		sm := builder.BuildOrDie()
+		builder.AddFail("B")
+
+		if _, err := sm.Run(context.Background(), map[string]any{}); err != nil {
+			t.Errorf("Expected the built machine to keep its states, got %v", err)
+		}
 	})
 }
 
@@ -187,13 +265,2262 @@ func TestJSONStateMachine(t *testing.T) {
 			t.Fatalf("Failed to parse JSON file: %v", err)
 		}
 
-		err = sm.Run(context.Background(), map[string]any{})
+		exec, err := sm.Run(context.Background(), map[string]any{})
 		if err == nil {
 			t.Fatal("Expected workflow to fail, but it succeeded")
 		}
 
-		if sm.Context.Data["attempts"] != float64(4) {
-			t.Errorf("Expected 4 attempts, got %v", sm.Context.Data["attempts"])
+		if exec.Output()["attempts"] != float64(4) {
+			t.Errorf("Expected 4 attempts, got %v", exec.Output()["attempts"])
+		}
+	})
+}
+
+func TestDataFlow(t *testing.T) {
+	t.Run("Task result is merged at ResultPath", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("PriceTask").
+			AddTask("PriceTask", func(ctx context.Context, sc *statemachine.StateContext) error {
+				if _, ok := sc.Data["items_to_process"]; ok {
+					return fmt.Errorf("task saw data outside its InputPath")
+				}
+				sc.Data["total"] = sc.Data["price"].(float64) * sc.Data["qty"].(float64)
+				return nil
+			}, "Done", statemachine.WithDataFlow(statemachine.DataFlow{
+				InputPath:      "$.order",
+				Parameters:     map[string]any{"price.$": "$.price", "qty": float64(3)},
+				ResultSelector: map[string]any{"amount.$": "$.total"},
+				ResultPath:     "$.invoice",
+			})).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{
+			"order":            map[string]any{"price": float64(5)},
+			"items_to_process": []any{1},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		invoice, _ := exec.Output()["invoice"].(map[string]any)
+		if invoice["amount"] != float64(15) {
+			t.Errorf("Expected invoice amount 15, got %v", exec.Output()["invoice"])
+		}
+		if _, ok := exec.Output()["order"]; !ok {
+			t.Errorf("Expected original input to be kept next to the result")
+		}
+	})
+
+	t.Run("OutputPath filters what the next state sees", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Select").
+			AddPass("Select", "Done", nil, statemachine.WithOutputPath("$.customer")).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{
+			"customer": map[string]any{"id": "c-1"},
+			"secret":   "hidden",
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if exec.Output()["id"] != "c-1" || exec.Output()["secret"] != nil {
+			t.Errorf("Unexpected output: %v", exec.Output())
+		}
+	})
+
+	t.Run("Map results default to map_output", func(t *testing.T) {
+		branch := statemachine.NewStateMachineBuilder().StartAt("Done").AddEnd("Done").BuildOrDie()
+		built := statemachine.NewStateMachineBuilder().
+			StartAt("Process").
+			AddMap("Process", "items", "", branch, "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		definition := `{
+			"StartAt": "Process",
+			"States": {
+				"Process": {
+					"Type": "Map",
+					"ItemsPath": "$.items",
+					"Iterator": {"StartAt": "Done", "States": {"Done": {"Type": "End"}}},
+					"Next": "Done"
+				},
+				"Done": {"Type": "End"}
+			}
+		}`
+		parsed, err := statemachine.ParseStateMachine(writeDefinition(t, definition), nil)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+
+		for _, sm := range []*statemachine.StateMachine{built, parsed} {
+			exec, err := sm.Run(context.Background(), map[string]any{"items": []any{1, 2}})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if results, _ := exec.Output()["map_output"].([]any); len(results) != 2 {
+				t.Errorf("Expected two results under map_output, got %v", exec.Output())
+			}
+		}
+	})
+
+	t.Run("Choice and Wait definitions only take InputPath and OutputPath", func(t *testing.T) {
+		for _, state := range []string{
+			`{"Type": "Choice", "Choices": [], "Default": "Done", "ResultPath": "$.choice"}`,
+			`{"Type": "Wait", "Seconds": 0, "Next": "Done", "Parameters": {"a": 1}}`,
+			`{"Type": "Wait", "Seconds": 0, "Next": "Done", "ResultSelector": {"a": 1}}`,
+		} {
+			definition := `{
+				"StartAt": "Check",
+				"States": {"Check": ` + state + `, "Done": {"Type": "End"}}
+			}`
+			if _, err := statemachine.ParseStateMachine(writeDefinition(t, definition), nil); err == nil {
+				t.Errorf("Expected %s to be rejected", state)
+			}
+		}
+	})
+}
+
+func TestJSONPath(t *testing.T) {
+	input := map[string]any{
+		"order": map[string]any{
+			"items": []any{
+				map[string]any{"sku": "A-1"},
+				map[string]any{"sku": "B-2"},
+				map[string]any{"sku": "C-3"},
+			},
+		},
+		"results": []any{
+			map[string]any{"id": float64(1)},
+			map[string]any{"id": float64(2)},
+		},
+	}
+
+	t.Run("Nested, indexed, sliced, wildcard and context paths", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Select").
+			AddPass("Select", "Done", nil, statemachine.WithDataFlow(statemachine.DataFlow{
+				Parameters: map[string]any{
+					"first.$":  "$.order.items[0].sku",
+					"last.$":   "$['order']['items'][-1].sku",
+					"middle.$": "$.order.items[1:2]",
+					"ids.$":    "$.results[*].id",
+					"exec.$":   "$$.Execution.Id",
+					"state.$":  "$$.State.Name",
+				},
+			})).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), input, statemachine.WithExecutionID("exec-1"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		out := exec.Output()
+		if out["first"] != "A-1" || out["last"] != "C-3" {
+			t.Errorf("Unexpected indexed values: first=%v last=%v", out["first"], out["last"])
+		}
+		if middle, _ := out["middle"].([]any); len(middle) != 1 {
+			t.Errorf("Expected a single sliced item, got %v", out["middle"])
+		}
+		if ids, _ := out["ids"].([]any); len(ids) != 2 || ids[0] != float64(1) || ids[1] != float64(2) {
+			t.Errorf("Unexpected wildcard result: %v", out["ids"])
+		}
+		if out["exec"] != "exec-1" || out["state"] != "Select" {
+			t.Errorf("Unexpected context values: exec=%v state=%v", out["exec"], out["state"])
+		}
+	})
+
+	t.Run("Unresolved path fails the state", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Select").
+			AddPass("Select", "Done", nil, statemachine.WithInputPath("$.order.customer.id")).
+			AddEnd("Done").
+			BuildOrDie()
+
+		_, err := sm.Run(context.Background(), input)
+		if err == nil {
+			t.Fatal("Expected an error for a path that does not resolve")
+		}
+		if !strings.Contains(err.Error(), "field 'customer' not found") {
+			t.Errorf("Expected a clear path error, got %q", err.Error())
+		}
+	})
+
+	t.Run("Malformed paths are rejected before the execution", func(t *testing.T) {
+		branch := statemachine.NewStateMachineBuilder().StartAt("Done").AddEnd("Done").BuildOrDie()
+		for name, add := range map[string]func(*statemachine.StateMachineBuilder){
+			"ResultPath without $": func(b *statemachine.StateMachineBuilder) {
+				b.AddTask("Start", testTasks["SucceedingTask"], "Done", statemachine.WithResultPath("result"))
+			},
+			"ResultPath with a wildcard": func(b *statemachine.StateMachineBuilder) {
+				b.AddPass("Start", "Done", nil, statemachine.WithResultPath("$.items[*]"))
+			},
+			"InputPath": func(b *statemachine.StateMachineBuilder) {
+				b.AddWait("Start", 0, "Done", statemachine.WithInputPath("$.a["))
+			},
+			"Parameters path": func(b *statemachine.StateMachineBuilder) {
+				b.AddParallel("Start", nil, "Done", statemachine.WithParameters(map[string]any{"nested": map[string]any{"id.$": "id"}}))
+			},
+			"ItemSelector path": func(b *statemachine.StateMachineBuilder) {
+				b.AddMap("Start", "items", "results", branch, "Done", statemachine.WithItemSelector(map[string]any{"value.$": "$$.Map.Item.Value["}))
+			},
+			"Choice variable": func(b *statemachine.StateMachineBuilder) {
+				b.AddChoice("Start", []statemachine.ChoiceRule{{Condition: statemachine.StringEquals("x.y", "v"), Next: "Done"}}, "Done")
+			},
+		} {
+			builder := statemachine.NewStateMachineBuilder().StartAt("Start")
+			add(builder)
+			if _, err := builder.AddEnd("Done").Build(); err == nil {
+				t.Errorf("%s: expected Build to fail", name)
+			}
+		}
+
+		for _, state := range []string{
+			`{"Type": "Map", "ItemsPath": "items", "Iterator": {"StartAt": "Done", "States": {"Done": {"Type": "End"}}}, "Next": "Done"}`,
+			`{"Type": "Choice", "Choices": [{"Variable": "$.a", "Condition": {"StringEqualsPath": "b"}, "Next": "Done"}], "Default": "Done"}`,
+			`{"Type": "Pass", "OutputPath": "$$..a", "Next": "Done"}`,
+		} {
+			definition := `{
+				"StartAt": "Start",
+				"States": {"Start": ` + state + `, "Done": {"Type": "End"}}
+			}`
+			if _, err := statemachine.ParseStateMachine(writeDefinition(t, definition), nil); err == nil {
+				t.Errorf("Expected %s to be rejected", state)
+			}
+		}
+	})
+}
+
+func TestChoiceOperators(t *testing.T) {
+	input := map[string]any{
+		"amount":   float64(1500),
+		"limit":    float64(1000),
+		"region":   "eu-west-1",
+		"approved": false,
+		"created":  "2024-05-01T12:00:00Z",
+		"note":     nil,
+	}
+
+	tests := []struct {
+		name      string
+		condition map[string]any
+		want      bool
+	}{
+		{"NumericGreaterThan", map[string]any{"InputPath": "$.amount", "NumericGreaterThan": 1000}, true},
+		{"NumericLessThanEquals", map[string]any{"InputPath": "$.amount", "NumericLessThanEquals": float64(1000)}, false},
+		{"NumericGreaterThanPath", map[string]any{"InputPath": "$.amount", "NumericGreaterThanPath": "$.limit"}, true},
+		{"StringLessThan", map[string]any{"InputPath": "$.region", "StringLessThan": "us"}, true},
+		{"StringMatches", map[string]any{"InputPath": "$.region", "StringMatches": "eu-*-1"}, true},
+		{"StringMatches escaped", map[string]any{"InputPath": "$.region", "StringMatches": `eu-\*`}, false},
+		{"BooleanEquals", map[string]any{"InputPath": "$.approved", "BooleanEquals": false}, true},
+		{"TimestampLessThan", map[string]any{"InputPath": "$.created", "TimestampLessThan": "2024-06-01T00:00:00Z"}, true},
+		{"TimestampEquals wrong type", map[string]any{"InputPath": "$.amount", "TimestampEquals": "2024-05-01T12:00:00Z"}, false},
+		{"IsPresent", map[string]any{"InputPath": "$.missing", "IsPresent": false}, true},
+		{"IsNull", map[string]any{"InputPath": "$.note", "IsNull": true}, true},
+		{"IsString", map[string]any{"InputPath": "$.amount", "IsString": true}, false},
+		{"IsNumeric", map[string]any{"InputPath": "$.amount", "IsNumeric": true}, true},
+		{"IsBoolean", map[string]any{"InputPath": "$.approved", "IsBoolean": true}, true},
+		{"IsTimestamp", map[string]any{"InputPath": "$.created", "IsTimestamp": true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := statemachine.NewStateMachineBuilder().
+				StartAt("Route").
+				AddChoice("Route", []statemachine.ChoiceRule{{Condition: tt.condition, Next: "Matched"}}, "Default").
+				AddPass("Matched", "", func(sc *statemachine.StateContext) { sc.Data["route"] = "matched" }).
+				AddPass("Default", "", func(sc *statemachine.StateContext) { sc.Data["route"] = "default" }).
+				BuildOrDie()
+
+			exec, err := sm.Run(context.Background(), input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := exec.Output()["route"] == "matched"; got != tt.want {
+				t.Errorf("Expected match=%v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Missing variable is an error", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Route").
+			AddChoice("Route", []statemachine.ChoiceRule{
+				{Condition: map[string]any{"InputPath": "$.missing", "StringEquals": "x"}, Next: "Done"},
+			}, "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		if _, err := sm.Run(context.Background(), input); err == nil {
+			t.Fatal("Expected an error for a missing variable")
+		}
+	})
+}
+
+func TestChoiceComposition(t *testing.T) {
+	approval := []map[string]any{
+		{"amount": float64(1500), "region": "EU", "flagged": false},
+		{"amount": float64(1500), "region": "EU", "flagged": true},
+		{"amount": float64(500), "region": "EU", "flagged": false},
+		{"amount": float64(1500), "region": "US", "flagged": false},
+	}
+	want := []string{"manual", "auto", "auto", "auto"}
+
+	t.Run("Builder API", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Route").
+			AddChoice("Route", []statemachine.ChoiceRule{{
+				Condition: statemachine.And(
+					statemachine.Condition{"InputPath": "$.amount", "NumericGreaterThan": 1000},
+					statemachine.Condition{"InputPath": "$.region", "StringEquals": "EU"},
+					statemachine.Not(statemachine.Condition{"InputPath": "$.flagged", "BooleanEquals": true}),
+				),
+				Next: "Manual",
+			}}, "Auto").
+			AddPass("Manual", "", func(sc *statemachine.StateContext) { sc.Data["review"] = "manual" }).
+			AddPass("Auto", "", func(sc *statemachine.StateContext) { sc.Data["review"] = "auto" }).
+			BuildOrDie()
+
+		for i, input := range approval {
+			exec, err := sm.Run(context.Background(), input)
+			if err != nil {
+				t.Fatalf("Input %d: unexpected error: %v", i, err)
+			}
+			if exec.Output()["review"] != want[i] {
+				t.Errorf("Input %d: expected %s review, got %v", i, want[i], exec.Output()["review"])
+			}
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		definition := `{
+			"StartAt": "Route",
+			"States": {
+				"Route": {
+					"Type": "Choice",
+					"Choices": [{
+						"Condition": {
+							"And": [
+								{"InputPath": "$.amount", "NumericGreaterThan": 1000},
+								{"Or": [
+									{"InputPath": "$.region", "StringEquals": "EU"},
+									{"InputPath": "$.region", "StringEquals": "UK"}
+								]},
+								{"Not": {"InputPath": "$.flagged", "BooleanEquals": true}}
+							]
+						},
+						"Next": "Manual"
+					}],
+					"Default": "Auto"
+				},
+				"Manual": {"Type": "Pass", "Parameters": {"review": "manual"}, "Next": "Done"},
+				"Auto": {"Type": "Pass", "Parameters": {"review": "auto"}, "Next": "Done"},
+				"Done": {"Type": "End"}
+			}
+		}`
+		sm, err := statemachine.ParseStateMachine(writeDefinition(t, definition), nil)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+
+		for i, input := range approval {
+			exec, err := sm.Run(context.Background(), input)
+			if err != nil {
+				t.Fatalf("Input %d: unexpected error: %v", i, err)
+			}
+			if exec.Output()["review"] != want[i] {
+				t.Errorf("Input %d: expected %s review, got %v", i, want[i], exec.Output()["review"])
+			}
+		}
+	})
+
+	t.Run("And short-circuits", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Route").
+			AddChoice("Route", []statemachine.ChoiceRule{{
+				Condition: statemachine.And(
+					statemachine.Condition{"InputPath": "$.amount", "NumericLessThan": 0},
+					statemachine.Condition{"InputPath": "$.missing", "StringEquals": "never evaluated"},
+				),
+				Next: "Done",
+			}}, "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		if _, err := sm.Run(context.Background(), approval[0]); err != nil {
+			t.Fatalf("Expected the second condition to be skipped, got: %v", err)
+		}
+	})
+}
+
+func TestChoiceVariables(t *testing.T) {
+	t.Run("Rule without a variable is rejected at build time", func(t *testing.T) {
+		_, err := statemachine.NewStateMachineBuilder().
+			StartAt("Route").
+			AddChoice("Route", []statemachine.ChoiceRule{
+				{Condition: statemachine.Condition{"StringEquals": "go"}, Next: "Done"},
+			}, "Done").
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Fatal("Expected Build to reject a rule that references no variable")
+		}
+	})
+
+	t.Run("Typed constructors and rule variables", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Route").
+			AddChoice("Route", []statemachine.ChoiceRule{
+				{
+					Variable: "$.order.total",
+					Condition: statemachine.And(
+						statemachine.Condition{"NumericGreaterThanEquals": 100},
+						statemachine.StringMatches("$.order.id", "ord-*"),
+						statemachine.ComparePaths("$.order.total", "NumericLessThan", "$.limit"),
+					),
+					Next: "Large",
+				},
+			}, "Small").
+			AddPass("Large", "", func(sc *statemachine.StateContext) { sc.Data["size"] = "large" }).
+			AddPass("Small", "", func(sc *statemachine.StateContext) { sc.Data["size"] = "small" }).
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{
+			"order": map[string]any{"id": "ord-7", "total": float64(150)},
+			"limit": float64(200),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if exec.Output()["size"] != "large" {
+			t.Errorf("Expected the large path, got %v", exec.Output()["size"])
+		}
+	})
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	sm := statemachine.NewStateMachineBuilder().
+		StartAt("Flaky").
+		AddTask("Flaky", testTasks["TestRetryCatch"], "Done",
+			statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", Interval: time.Millisecond, MaxAttempts: 1},
+			statemachine.CatchRule{ErrorName: "API_BAD_GATEWAY", NextState: "Done"}).
+		AddEnd("Done").
+		BuildOrDie()
+
+	if _, err := sm.Run(context.Background(), map[string]any{}, statemachine.WithExecutionID("exec-log"), statemachine.WithLogger(logger)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var attempts int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		if record["execution_id"] != "exec-log" {
+			t.Errorf("Expected execution_id on every record, got %v", record)
+		}
+		if record["msg"] == "task attempt failed" {
+			attempts++
+			if record["state"] != "Flaky" || record["state_type"] != "Task" || record["attempt"] != float64(attempts) || record["error"] == nil {
+				t.Errorf("Missing structured fields on %v", record)
+			}
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 failed attempts to be logged, got %d", attempts)
+	}
+}
+
+func TestListener(t *testing.T) {
+	var mu sync.Mutex
+	var events []statemachine.Event
+	listener := statemachine.ListenerFunc(func(event statemachine.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	})
+
+	sm := buildTestStateMachine()
+	_, err := sm.Run(context.Background(), map[string]any{}, statemachine.WithExecutionID("exec-events"), statemachine.WithListener(listener))
+	if err == nil {
+		t.Fatal("Expected workflow to fail, but it succeeded")
+	}
+
+	counts := map[statemachine.EventType]int{}
+	var children int
+	for _, event := range events {
+		if event.ExecutionID == "exec-events" {
+			counts[event.Type]++
+		} else if event.ParentExecutionID == "exec-events" && event.Type == statemachine.EventExecutionSucceeded {
+			children++
+		}
+	}
+
+	if events[0].Type != statemachine.EventExecutionStarted || events[0].ExecutionID != "exec-events" {
+		t.Errorf("Expected the first event to be ExecutionStarted, got %+v", events[0])
+	}
+	last := events[len(events)-1]
+	if last.Type != statemachine.EventExecutionFailed || last.StateName != "FailState" {
+		t.Errorf("Expected the last event to be ExecutionFailed in FailState, got %+v", last)
+	}
+
+	expected := map[statemachine.EventType]int{
+		statemachine.EventTaskAttemptFailed:       4,
+		statemachine.EventRetryScheduled:          3,
+		statemachine.EventErrorCaught:             1,
+		statemachine.EventMapIterationStarted:     3,
+		statemachine.EventMapIterationSucceeded:   3,
+		statemachine.EventParallelBranchSucceeded: 2,
+	}
+	for eventType, want := range expected {
+		if counts[eventType] != want {
+			t.Errorf("Expected %d %s events, got %d", want, eventType, counts[eventType])
+		}
+	}
+	if counts[statemachine.EventStateEntered] != counts[statemachine.EventStateExited]+1 {
+		t.Errorf("Expected every state but the failing one to exit, got %d entered and %d exited",
+			counts[statemachine.EventStateEntered], counts[statemachine.EventStateExited])
+	}
+	if children != 5 {
+		t.Errorf("Expected 5 nested executions to report to the listener, got %d", children)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	sm := buildTestStateMachine()
+	exec, err := sm.Run(context.Background(), map[string]any{})
+	if err == nil {
+		t.Fatal("Expected workflow to fail, but it succeeded")
+	}
+	history := exec.History()
+
+	for i, event := range history.Events {
+		if event.ID != i+1 {
+			t.Fatalf("Expected event %d to have ID %d, got %d", i, i+1, event.ID)
+		}
+	}
+
+	entered := history.Filter(statemachine.EventStateEntered)
+	if len(entered) == 0 || entered[0].StateName != "StartTask" || entered[0].Input == nil {
+		t.Errorf("Expected the first state entry to be StartTask with an input snapshot, got %+v", entered)
+	}
+
+	attempts := history.State("TestRetryCatch")
+	var failed int
+	for _, event := range attempts {
+		if event.Type == statemachine.EventTaskAttemptFailed {
+			failed++
+			if event.Error == nil || event.Duration <= 0 {
+				t.Errorf("Expected attempt %d to carry its error and duration", event.Attempt)
+			}
+		}
+	}
+	if failed != 4 {
+		t.Errorf("Expected 4 failed attempts in the history, got %d", failed)
+	}
+
+	iterations := history.Filter(statemachine.EventMapIterationSucceeded)
+	if len(iterations) != 3 {
+		t.Fatalf("Expected 3 finished map iterations, got %d", len(iterations))
+	}
+	for _, iteration := range iterations {
+		nested := iteration.Nested
+		if nested == nil || nested.ExecutionID != iteration.ChildExecutionID {
+			t.Fatalf("Expected iteration %d to carry its own history", iteration.Index)
+		}
+		if len(nested.Filter(statemachine.EventTaskAttemptSucceeded)) != 1 {
+			t.Errorf("Expected iteration %d to record its task attempt", iteration.Index)
+		}
+	}
+
+	if failures := history.Failures(); len(failures) != 5 {
+		t.Errorf("Expected 4 failed attempts and the execution failure, got %d failures", len(failures))
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		t.Fatalf("Failed to export history: %v", err)
+	}
+	var exported struct {
+		ExecutionId string
+		Events      []map[string]any
+	}
+	if err := json.Unmarshal(data, &exported); err != nil {
+		t.Fatalf("Exported history is not valid JSON: %v", err)
+	}
+	lastEvent := exported.Events[len(exported.Events)-1]
+	if exported.ExecutionId != exec.ID || lastEvent["Type"] != "ExecutionFailed" || lastEvent["Error"] == nil {
+		t.Errorf("Unexpected exported history tail: %v", lastEvent)
+	}
+
+	t.Run("WithHistory(false) records no events", func(t *testing.T) {
+		var mu sync.Mutex
+		var iterations int
+		listener := statemachine.ListenerFunc(func(event statemachine.Event) {
+			if event.Type == statemachine.EventMapIterationSucceeded {
+				mu.Lock()
+				iterations++
+				mu.Unlock()
+			}
+		})
+		exec, _ := sm.Run(context.Background(), map[string]any{}, statemachine.WithHistory(false), statemachine.WithListener(listener))
+		if events := exec.History().Events; len(events) != 0 {
+			t.Errorf("Expected no recorded events, got %d", len(events))
+		}
+		if iterations != 3 {
+			t.Errorf("Expected the listener to still receive 3 map iterations, got %d", iterations)
+		}
+	})
+}
+
+func TestCheckpointResume(t *testing.T) {
+	newStores := map[string]func(t *testing.T) statemachine.Store{
+		"FileStore": func(t *testing.T) statemachine.Store {
+			store, err := statemachine.NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("Failed to create file store: %v", err)
+			}
+			return store
+		},
+		"JournalStore": func(t *testing.T) statemachine.Store {
+			path := filepath.Join(t.TempDir(), "journal.jsonl")
+			store, err := statemachine.OpenJournalStore(path)
+			if err != nil {
+				t.Fatalf("Failed to open journal store: %v", err)
+			}
+			// Reopen the journal to check that checkpoints are replayed from disk.
+			t.Cleanup(func() { store.Close() })
+			return &reopeningStore{Store: store, path: path, t: t}
+		},
+	}
+
+	for name, newStore := range newStores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx, crash := context.WithCancel(context.Background())
+			var firstRuns, secondRuns int
+			sm := statemachine.NewStateMachineBuilder().
+				StartAt("First").
+				AddTask("First", func(ctx context.Context, sc *statemachine.StateContext) error {
+					firstRuns++
+					sc.Data["first"] = "done"
+					return nil
+				}, "Second").
+				AddTask("Second", func(ctx context.Context, sc *statemachine.StateContext) error {
+					secondRuns++
+					if secondRuns < 3 {
+						return &statemachine.CustomError{Name: "API_BAD_GATEWAY", Err: statemachine.ErrAPIBadGateway}
+					}
+					if secondRuns == 3 {
+						// Simulate the process stopping in the middle of the third attempt.
+						crash()
+						return ctx.Err()
+					}
+					sc.Data["second"] = "done"
+					return nil
+				}, "Done", statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", Interval: 10 * time.Millisecond, MaxAttempts: 3}).
+				AddEnd("Done").
+				BuildOrDie()
+
+			exec, err := sm.Run(ctx, map[string]any{"order": "42"}, statemachine.WithStore(store))
+			if err == nil || exec.Status() != statemachine.ExecutionAborted {
+				t.Fatalf("Expected the execution to be aborted, got %s: %v", exec.Status(), err)
+			}
+
+			checkpoint, err := store.Load(context.Background(), exec.ID)
+			if err != nil {
+				t.Fatalf("Failed to load checkpoint: %v", err)
+			}
+			if checkpoint.Status != statemachine.ExecutionRunning || checkpoint.StateName != "Second" || checkpoint.Attempts != 2 {
+				t.Fatalf("Expected a running checkpoint in Second after 2 attempts, got %+v", checkpoint)
+			}
+
+			resumed, err := sm.Resume(context.Background(), store, exec.ID)
+			if err != nil {
+				t.Fatalf("Failed to resume: %v", err)
+			}
+			if err := resumed.Wait(); err != nil {
+				t.Fatalf("Expected the resumed execution to succeed, got %v", err)
+			}
+			if resumed.ID != exec.ID || !resumed.StartTime.Equal(exec.StartTime) {
+				t.Errorf("Expected the resumed execution to keep its ID and start time")
+			}
+			if firstRuns != 1 || secondRuns != 4 {
+				t.Errorf("Expected First to run once and Second 4 times, got %d and %d", firstRuns, secondRuns)
+			}
+			output := resumed.Output()
+			if output["order"] != "42" || output["first"] != "done" || output["second"] != "done" {
+				t.Errorf("Unexpected output after resume: %v", output)
+			}
+			// The interrupted third attempt was never checkpointed, so it is made again.
+			attempts := resumed.History().Filter(statemachine.EventTaskAttemptStarted)
+			if len(attempts) != 1 || attempts[0].Attempt != 3 {
+				t.Errorf("Expected the resumed execution to continue with attempt 3, got %+v", attempts)
+			}
+
+			if _, err := sm.Resume(context.Background(), store, exec.ID); err == nil {
+				t.Error("Expected resuming a finished execution to fail")
+			}
+			if _, err := sm.Resume(context.Background(), store, "unknown"); !errors.Is(err, statemachine.ErrCheckpointNotFound) {
+				t.Errorf("Expected ErrCheckpointNotFound, got %v", err)
+			}
+
+			if err := store.Delete(context.Background(), exec.ID); err != nil {
+				t.Fatalf("Failed to delete checkpoint: %v", err)
+			}
+			if _, err := store.Load(context.Background(), exec.ID); !errors.Is(err, statemachine.ErrCheckpointNotFound) {
+				t.Errorf("Expected the deleted checkpoint to be gone, got %v", err)
+			}
+			if err := store.Delete(context.Background(), exec.ID); err != nil {
+				t.Errorf("Expected deleting a missing checkpoint to succeed, got %v", err)
+			}
+		})
+	}
+
+	t.Run("JournalStore recovers from a torn write", func(t *testing.T) {
+		ctx := context.Background()
+		path := filepath.Join(t.TempDir(), "journal.jsonl")
+		store, err := statemachine.OpenJournalStore(path)
+		if err != nil {
+			t.Fatalf("Failed to open journal store: %v", err)
+		}
+		for _, id := range []string{"a", "b"} {
+			if err := store.Save(ctx, statemachine.Checkpoint{ExecutionID: id, Status: statemachine.ExecutionRunning}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		store.Close()
+		// Simulate a crash in the middle of writing a checkpoint.
+		journal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal.WriteString(`{"ExecutionId":"torn","Sta`)
+		journal.Close()
+
+		store, err = statemachine.OpenJournalStore(path)
+		if err != nil {
+			t.Fatalf("Expected a torn last line to be tolerated, got %v", err)
+		}
+		if err := store.Save(ctx, statemachine.Checkpoint{ExecutionID: "c", Status: statemachine.ExecutionRunning}); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		store, err = statemachine.OpenJournalStore(path)
+		if err != nil {
+			t.Fatalf("Failed to reopen journal store: %v", err)
+		}
+		defer store.Close()
+		for _, id := range []string{"a", "b", "c"} {
+			if _, err := store.Load(ctx, id); err != nil {
+				t.Errorf("Expected checkpoint %s to survive, got %v", id, err)
+			}
+		}
+	})
+
+	t.Run("JournalStore rejects corrupt records", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "journal.jsonl")
+		if err := os.WriteFile(path, []byte("{\"ExecutionId\":\"a\"}\nnot json\n{\"ExecutionId\":\"b\"}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := statemachine.OpenJournalStore(path); err == nil {
+			t.Error("Expected a corrupt record before the last line to be an error")
+		}
+	})
+}
+
+// reopeningStore loads every checkpoint from a freshly opened journal, as a
+// new process would.
+type reopeningStore struct {
+	statemachine.Store
+	path string
+	t    *testing.T
+}
+
+func (s *reopeningStore) Load(ctx context.Context, executionID string) (statemachine.Checkpoint, error) {
+	store, err := statemachine.OpenJournalStore(s.path)
+	if err != nil {
+		s.t.Fatalf("Failed to reopen journal store: %v", err)
+	}
+	defer store.Close()
+	return store.Load(ctx, executionID)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	badGateway := func(ctx context.Context, sc *statemachine.StateContext) error {
+		return &statemachine.CustomError{Name: "API_BAD_GATEWAY", Err: statemachine.ErrAPIBadGateway}
+	}
+	retryDelays := func(exec *statemachine.Execution) []time.Duration {
+		var delays []time.Duration
+		for _, event := range exec.History().Filter(statemachine.EventRetryScheduled) {
+			delays = append(delays, event.RetryDelay)
+		}
+		return delays
+	}
+
+	t.Run("Exponential backoff capped at MaxDelay", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", badGateway, "Done", statemachine.RetryRule{
+				ErrorName:      "API_BAD_GATEWAY",
+				Interval:       10 * time.Millisecond,
+				MaxAttempts:    4,
+				BackoffRate:    2,
+				MaxDelay:       30 * time.Millisecond,
+				JitterStrategy: statemachine.JitterNone,
+			}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, _ := sm.Run(context.Background(), map[string]any{})
+		want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond}
+		if got := retryDelays(exec); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected retry delays %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Full jitter stays below the computed delay", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", badGateway, "Done", statemachine.RetryRule{
+				ErrorName:      "API_BAD_GATEWAY",
+				Interval:       20 * time.Millisecond,
+				MaxAttempts:    3,
+				BackoffRate:    1.5,
+				JitterStrategy: statemachine.JitterFull,
+			}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, _ := sm.Run(context.Background(), map[string]any{})
+		limits := []time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 45 * time.Millisecond}
+		delays := retryDelays(exec)
+		if len(delays) != len(limits) {
+			t.Fatalf("Expected %d retries, got %d", len(limits), len(delays))
+		}
+		for i, delay := range delays {
+			if delay < 0 || delay > limits[i] {
+				t.Errorf("Expected retry %d to wait at most %v, got %v", i+1, limits[i], delay)
+			}
+		}
+	})
+
+	t.Run("Invalid rules are rejected", func(t *testing.T) {
+		_, err := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", badGateway, "Done", statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", BackoffRate: 0.5}).
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Error("Expected a BackoffRate below 1 to be rejected")
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		retryDefinition := func(retry string) string {
+			definition := `{
+				"StartAt": "Call",
+				"States": {
+					"Call": {"Type": "Task", "Retry": [` + retry + `], "Next": "Done"},
+					"Done": {"Type": "End"}
+				}
+			}`
+			return writeDefinition(t, definition)
+		}
+		tasks := map[string]statemachine.TaskFn{"Call": badGateway}
+
+		sm, err := statemachine.ParseStateMachine(retryDefinition(`{
+			"ErrorEquals": ["API_BAD_GATEWAY"], "IntervalSeconds": 2, "MaxAttempts": 1,
+			"BackoffRate": 2.0, "MaxDelaySeconds": 1, "JitterStrategy": "NONE"
+		}`), tasks)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		exec, _ := sm.Run(context.Background(), map[string]any{})
+		if got := retryDelays(exec); len(got) != 1 || got[0] != time.Second {
+			t.Errorf("Expected one retry capped at 1s, got %v", got)
+		}
+
+		if _, err := statemachine.ParseStateMachine(retryDefinition(`{
+			"ErrorEquals": ["API_BAD_GATEWAY"], "IntervalSeconds": 1, "MaxAttempts": 1, "JitterStrategy": "PARTIAL"
+		}`), tasks); err == nil {
+			t.Error("Expected an unknown JitterStrategy to be rejected")
+		}
+	})
+}
+
+func TestErrorMatching(t *testing.T) {
+	failWith := func(err error) statemachine.TaskFn {
+		return func(ctx context.Context, sc *statemachine.StateContext) error {
+			return err
+		}
+	}
+	slow := func(ctx context.Context, sc *statemachine.StateContext) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	// caughtBy runs fn in a task with the given catch rules and returns the
+	// state the error was routed to and the name it was matched by.
+	caughtBy := func(t *testing.T, fn statemachine.TaskFn, timeout time.Duration, catches ...statemachine.CatchRule) (string, string) {
+		t.Helper()
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", fn, "Done", statemachine.WithTimeout(timeout), statemachine.WithCatch(catches...)).
+			AddPass("Cleanup", "Done", nil).
+			AddPass("Retreat", "Done", nil).
+			AddEnd("Done").
+			BuildOrDie()
+		exec, _ := sm.Run(context.Background(), map[string]any{})
+		caught := exec.History().Filter(statemachine.EventErrorCaught)
+		if len(caught) == 0 {
+			return "", ""
+		}
+		return caught[0].NextState, caught[0].ErrorName
+	}
+
+	t.Run("Every name in ErrorEquals is honoured", func(t *testing.T) {
+		next, name := caughtBy(t, failWith(statemachine.ErrAPIBadGateway), 0,
+			statemachine.CatchRule{ErrorEquals: []string{"THROTTLED", "API_BAD_GATEWAY"}, NextState: "Cleanup"})
+		if next != "Cleanup" || name != "API_BAD_GATEWAY" {
+			t.Errorf("Expected the second error name to match, got %q via %q", next, name)
+		}
+	})
+
+	t.Run("States.ALL catches everything", func(t *testing.T) {
+		next, name := caughtBy(t, failWith(fmt.Errorf("unexpected")), 0,
+			statemachine.CatchRule{ErrorName: "API_BAD_GATEWAY", NextState: "Retreat"},
+			statemachine.CatchRule{ErrorName: statemachine.ErrorAll, NextState: "Cleanup"})
+		if next != "Cleanup" || name != statemachine.ErrorAll {
+			t.Errorf("Expected States.ALL to catch the error, got %q via %q", next, name)
+		}
+	})
+
+	t.Run("States.TaskFailed excludes timeouts", func(t *testing.T) {
+		next, _ := caughtBy(t, failWith(statemachine.ErrPermissions), 0,
+			statemachine.CatchRule{ErrorName: statemachine.ErrorTaskFailed, NextState: "Cleanup"})
+		if next != "Cleanup" {
+			t.Errorf("Expected States.TaskFailed to catch a permissions error, got %q", next)
+		}
+		next, _ = caughtBy(t, slow, time.Second,
+			statemachine.CatchRule{ErrorName: statemachine.ErrorTaskFailed, NextState: "Retreat"},
+			statemachine.CatchRule{ErrorName: statemachine.ErrorTimeout, NextState: "Cleanup"})
+		if next != "Cleanup" {
+			t.Errorf("Expected States.Timeout to catch the timeout, got %q", next)
+		}
+	})
+
+	t.Run("States.Permissions", func(t *testing.T) {
+		next, _ := caughtBy(t, failWith(fmt.Errorf("reading bucket: %w", statemachine.ErrPermissions)), 0,
+			statemachine.CatchRule{ErrorName: statemachine.ErrorPermissions, NextState: "Cleanup"})
+		if next != "Cleanup" {
+			t.Errorf("Expected a wrapped ErrPermissions to be caught, got %q", next)
+		}
+	})
+
+	t.Run("States.ALL must be last and alone", func(t *testing.T) {
+		for _, catches := range [][]statemachine.CatchRule{
+			{{ErrorName: statemachine.ErrorAll, NextState: "Cleanup"}, {ErrorName: "API_BAD_GATEWAY", NextState: "Cleanup"}},
+			{{ErrorEquals: []string{statemachine.ErrorAll, "API_BAD_GATEWAY"}, NextState: "Cleanup"}},
+			{{NextState: "Cleanup"}},
+		} {
+			builder := statemachine.NewStateMachineBuilder().StartAt("Call").AddEnd("Cleanup")
+			if _, err := builder.AddTask("Call", failWith(nil), "Cleanup", statemachine.WithCatch(catches...)).Build(); err == nil {
+				t.Errorf("Expected catch rules %+v to be rejected", catches)
+			}
+		}
+	})
+
+	t.Run("Sentinel errors and predicates", func(t *testing.T) {
+		errNotReady := errors.New("not ready")
+		next, name := caughtBy(t, failWith(fmt.Errorf("polling: %w", errNotReady)), 0,
+			statemachine.CatchRule{Errors: []error{io.EOF}, NextState: "Retreat"},
+			statemachine.CatchRule{Errors: []error{errNotReady}, NextState: "Cleanup"})
+		if next != "Cleanup" || name != statemachine.ErrorTaskFailed {
+			t.Errorf("Expected the wrapped sentinel to be caught, got %q via %q", next, name)
+		}
+
+		next, _ = caughtBy(t, failWith(&quotaError{limit: 10}), 0,
+			statemachine.CatchRule{Match: func(err error) bool {
+				var quota *quotaError
+				return errors.As(err, &quota) && quota.limit < 100
+			}, NextState: "Cleanup"})
+		if next != "Cleanup" {
+			t.Errorf("Expected the predicate to catch the error, got %q", next)
+		}
+	})
+
+	t.Run("Well-known errors have stable names", func(t *testing.T) {
+		next, _ := caughtBy(t, failWith(fmt.Errorf("calling api: %w", context.DeadlineExceeded)), 0,
+			statemachine.CatchRule{ErrorName: statemachine.ErrorTimeout, NextState: "Cleanup"})
+		if next != "Cleanup" {
+			t.Errorf("Expected context.DeadlineExceeded to match States.Timeout, got %q", next)
+		}
+		next, _ = caughtBy(t, failWith(context.Canceled), 0,
+			statemachine.CatchRule{ErrorName: statemachine.ErrorCanceled, NextState: "Cleanup"})
+		if next != "Cleanup" {
+			t.Errorf("Expected context.Canceled to match States.Canceled, got %q", next)
+		}
+
+		panics := func(ctx context.Context, sc *statemachine.StateContext) error {
+			var m map[string]int
+			m["boom"]++
+			return nil
+		}
+		next, name := caughtBy(t, panics, 0,
+			statemachine.CatchRule{ErrorName: statemachine.ErrorRuntime, NextState: "Cleanup"})
+		if next != "Cleanup" || name != statemachine.ErrorRuntime {
+			t.Errorf("Expected the panic to be caught as States.Runtime, got %q via %q", next, name)
+		}
+	})
+
+	t.Run("Registered errors in JSON", func(t *testing.T) {
+		errMaintenance := errors.New("down for maintenance")
+		statemachine.RegisterError("Test.Maintenance", errMaintenance)
+		statemachine.RegisterErrorType[*quotaError]("Test.QuotaExceeded")
+
+		definition := `{
+			"StartAt": "Call",
+			"States": {
+				"Call": {
+					"Type": "Task",
+					"Catch": [
+						{"ErrorEquals": ["Test.Maintenance"], "Next": "Retreat"},
+						{"ErrorEquals": ["Test.QuotaExceeded"], "Next": "Cleanup"}
+					],
+					"Next": "Done"
+				},
+				"Retreat": {"Type": "Pass", "Parameters": {"route": "retreat"}, "Next": "Done"},
+				"Cleanup": {"Type": "Pass", "Parameters": {"route": "cleanup"}, "Next": "Done"},
+				"Done": {"Type": "End"}
+			}
+		}`
+		path := writeDefinition(t, definition)
+		for taskErr, route := range map[error]string{
+			fmt.Errorf("deploying: %w", errMaintenance): "retreat",
+			&quotaError{limit: 5}:                       "cleanup",
+		} {
+			sm, err := statemachine.ParseStateMachine(path, map[string]statemachine.TaskFn{"Call": failWith(taskErr)})
+			if err != nil {
+				t.Fatalf("Failed to parse JSON: %v", err)
+			}
+			exec, err := sm.Run(context.Background(), map[string]any{})
+			if err != nil {
+				t.Fatalf("Expected %v to be caught, got %v", taskErr, err)
+			}
+			if exec.Output()["route"] != route {
+				t.Errorf("Expected %v to route to %s, got %v", taskErr, route, exec.Output())
+			}
+			failed := exec.History().Filter(statemachine.EventTaskAttemptFailed)
+			if len(failed) != 1 || !strings.HasPrefix(failed[0].ErrorName, "Test.") {
+				t.Errorf("Expected the failed attempt to carry the registered name, got %+v", failed)
+			}
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		definition := `{
+			"StartAt": "Call",
+			"States": {
+				"Call": {
+					"Type": "Task",
+					"Retry": [{"ErrorEquals": ["THROTTLED", "API_BAD_GATEWAY"], "IntervalSeconds": 0, "MaxAttempts": 2}],
+					"Catch": [
+						{"ErrorEquals": ["THROTTLED"], "Next": "Retreat"},
+						{"ErrorEquals": ["States.ALL"], "Next": "Cleanup"}
+					],
+					"Next": "Done"
+				},
+				"Retreat": {"Type": "Pass", "Parameters": {"route": "retreat"}, "Next": "Done"},
+				"Cleanup": {"Type": "Pass", "Parameters": {"route": "cleanup"}, "Next": "Done"},
+				"Done": {"Type": "End"}
+			}
+		}`
+		sm, err := statemachine.ParseStateMachine(writeDefinition(t, definition), map[string]statemachine.TaskFn{"Call": failWith(statemachine.ErrAPIBadGateway)})
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil {
+			t.Fatalf("Expected the error to be caught, got %v", err)
+		}
+		if retries := exec.History().Filter(statemachine.EventRetryScheduled); len(retries) != 2 {
+			t.Errorf("Expected the second retry error name to match twice, got %d retries", len(retries))
+		}
+		if exec.Output()["route"] != "cleanup" {
+			t.Errorf("Expected States.ALL to route to Cleanup, got %v", exec.Output())
+		}
+	})
+}
+
+type quotaError struct {
+	limit int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("quota of %d exceeded", e.limit)
+}
+
+func TestCatchResultPath(t *testing.T) {
+	badGateway := func(ctx context.Context, sc *statemachine.StateContext) error {
+		return statemachine.ErrAPIBadGateway
+	}
+
+	t.Run("Error output is merged into the input", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", badGateway, "Done",
+				statemachine.CatchRule{ErrorName: statemachine.ErrorAll, NextState: "Done", ResultPath: "$.failure.details"}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{"order": "42"})
+		if err != nil {
+			t.Fatalf("Expected the error to be caught, got %v", err)
+		}
+		output := exec.Output()
+		failure, _ := output["failure"].(map[string]any)
+		details, _ := failure["details"].(map[string]any)
+		if output["order"] != "42" || details["Error"] != "API_BAD_GATEWAY" || details["Cause"] != statemachine.ErrAPIBadGateway.Error() {
+			t.Errorf("Unexpected output: %v", output)
+		}
+	})
+
+	t.Run("Root ResultPath replaces the input", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", badGateway, "Done",
+				statemachine.CatchRule{ErrorName: "API_BAD_GATEWAY", NextState: "Done", ResultPath: "$"}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, _ := sm.Run(context.Background(), map[string]any{"order": "42"})
+		if output := exec.Output(); len(output) != 2 || output["Error"] != "API_BAD_GATEWAY" {
+			t.Errorf("Expected only the error output, got %v", output)
+		}
+	})
+
+	t.Run("Invalid ResultPath is rejected", func(t *testing.T) {
+		_, err := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", badGateway, "Done",
+				statemachine.CatchRule{ErrorName: statemachine.ErrorAll, NextState: "Done", ResultPath: "$.errors[*]"}).
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Error("Expected a wildcard ResultPath to be rejected")
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		definition := `{
+			"StartAt": "Call",
+			"States": {
+				"Call": {
+					"Type": "Task",
+					"Catch": [{"ErrorEquals": ["States.ALL"], "ResultPath": "$.error", "Next": "Cleanup"}],
+					"Next": "Done"
+				},
+				"Cleanup": {"Type": "Pass", "Parameters": {"reason.$": "$.error.Error", "order.$": "$.order"}, "Next": "Done"},
+				"Done": {"Type": "End"}
+			}
+		}`
+		sm, err := statemachine.ParseStateMachine(writeDefinition(t, definition), map[string]statemachine.TaskFn{"Call": badGateway})
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		exec, err := sm.Run(context.Background(), map[string]any{"order": "42"})
+		if err != nil {
+			t.Fatalf("Expected the error to be caught, got %v", err)
+		}
+		if output := exec.Output(); output["reason"] != "API_BAD_GATEWAY" || output["order"] != "42" {
+			t.Errorf("Unexpected output: %v", output)
+		}
+	})
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Run("Task panics are retried", func(t *testing.T) {
+		var calls int
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Flaky").
+			AddTask("Flaky", func(ctx context.Context, sc *statemachine.StateContext) error {
+				calls++
+				if calls == 1 {
+					var order *struct{ ID string }
+					sc.Data["id"] = order.ID
+				}
+				return nil
+			}, "Done", statemachine.RetryRule{ErrorName: statemachine.ErrorRuntime, MaxAttempts: 1}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil {
+			t.Fatalf("Expected the retry to succeed, got %v", err)
+		}
+		failed := exec.History().Filter(statemachine.EventTaskAttemptFailed)
+		if len(failed) != 1 || failed[0].ErrorName != statemachine.ErrorRuntime {
+			t.Fatalf("Expected one States.Runtime failure, got %+v", failed)
+		}
+		var panicErr *statemachine.PanicError
+		if !errors.As(failed[0].Error, &panicErr) || !strings.Contains(string(panicErr.Stack), "main_test.go") {
+			t.Errorf("Expected the panic to carry the stack of the task, got %v", failed[0].Error)
+		}
+	})
+
+	panicky := statemachine.NewStateMachineBuilder().
+		StartAt("Check").
+		AddPass("Check", "Done", func(sc *statemachine.StateContext) {
+			if sc.Data["item"] == "bad" {
+				panic("bad item")
+			}
+		}).
+		AddEnd("Done").
+		BuildOrDie()
+
+	t.Run("Map iteration panics are caught", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Each").
+			AddMap("Each", "items", "results", panicky, "Done",
+				statemachine.CatchRule{ErrorName: statemachine.ErrorRuntime, NextState: "Done", ResultPath: "$.error"}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{"items": []any{"good", "bad"}})
+		if err != nil {
+			t.Fatalf("Expected the panic to be caught, got %v", err)
+		}
+		caught, _ := exec.Output()["error"].(map[string]any)
+		if caught["Error"] != statemachine.ErrorRuntime || !strings.Contains(fmt.Sprint(caught["Cause"]), "bad item") {
+			t.Errorf("Expected the error output of the panic, got %v", exec.Output())
+		}
+	})
+
+	t.Run("Parallel branch panics fail the execution", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Both").
+			AddParallel("Both", []*statemachine.StateMachine{panicky, panicky}, "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{"item": "bad"})
+		var panicErr *statemachine.PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "bad item" || exec.Status() != statemachine.ExecutionFailed {
+			t.Errorf("Expected the execution to fail with the panic, got %s: %v", exec.Status(), err)
+		}
+	})
+}
+
+func TestCooperativeTimeout(t *testing.T) {
+	t.Run("Late writes of an abandoned attempt are discarded", func(t *testing.T) {
+		returned := make(chan struct{})
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Stubborn").
+			AddTask("Stubborn", func(ctx context.Context, sc *statemachine.StateContext) error {
+				// Ignores its context on purpose.
+				defer close(returned)
+				time.Sleep(1500 * time.Millisecond)
+				sc.Data["late"] = true
+				return nil
+			}, "Done", statemachine.WithTimeout(time.Second), statemachine.CatchRule{ErrorName: statemachine.ErrorTimeout, NextState: "Done"}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{"order": "42"})
+		if err != nil {
+			t.Fatalf("Expected the timeout to be caught, got %v", err)
+		}
+		if exec.AbandonedTasks() != 1 {
+			t.Errorf("Expected 1 abandoned task attempt, got %d", exec.AbandonedTasks())
+		}
+		if abandoned := exec.History().Filter(statemachine.EventTaskAttemptAbandoned); len(abandoned) != 1 || abandoned[0].Attempt != 1 {
+			t.Errorf("Expected the abandoned attempt in the history, got %+v", abandoned)
+		}
+
+		<-returned
+		deadline := time.Now().Add(time.Second)
+		for exec.AbandonedTasks() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if exec.AbandonedTasks() != 0 {
+			t.Error("Expected the abandoned attempt to be released once it returned")
+		}
+		if _, ok := exec.Output()["late"]; ok || exec.Output()["order"] != "42" {
+			t.Errorf("Expected the late write to be discarded, got %v", exec.Output())
+		}
+	})
+
+	t.Run("Late writes through typed values are discarded", func(t *testing.T) {
+		type customer struct{ Name string }
+		returned := make(chan struct{})
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Stubborn").
+			AddTask("Stubborn", func(ctx context.Context, sc *statemachine.StateContext) error {
+				// Ignores its context on purpose.
+				defer close(returned)
+				time.Sleep(300 * time.Millisecond)
+				sc.Data["tags"].([]string)[0] = "late"
+				sc.Data["labels"].(map[string]string)["env"] = "late"
+				sc.Data["customer"].(*customer).Name = "late"
+				return nil
+			}, "Done", statemachine.WithTimeout(100*time.Millisecond), statemachine.CatchRule{ErrorName: statemachine.ErrorTimeout, NextState: "Done"}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{
+			"tags":     []string{"new"},
+			"labels":   map[string]string{"env": "prod"},
+			"customer": &customer{Name: "Ada"},
+		})
+		if err != nil {
+			t.Fatalf("Expected the timeout to be caught, got %v", err)
+		}
+		<-returned
+		output := exec.Output()
+		if output["tags"].([]string)[0] != "new" || output["labels"].(map[string]string)["env"] != "prod" || output["customer"].(*customer).Name != "Ada" {
+			t.Errorf("Expected the late writes to be discarded, got %v", output)
+		}
+	})
+
+	t.Run("Attempt contexts are cancelled when the attempt returns", func(t *testing.T) {
+		var attemptCtxs []context.Context
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", func(ctx context.Context, sc *statemachine.StateContext) error {
+				attemptCtxs = append(attemptCtxs, ctx)
+				if len(attemptCtxs) < 3 {
+					return statemachine.ErrAPIBadGateway
+				}
+				return nil
+			}, "Done", statemachine.WithTimeout(5*time.Second), statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", MaxAttempts: 3}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		if _, err := sm.Run(context.Background(), map[string]any{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i, ctx := range attemptCtxs {
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				t.Errorf("Expected the context of attempt %d to be cancelled, got %v", i+1, ctx.Err())
+			}
+		}
+	})
+}
+
+func TestHeartbeat(t *testing.T) {
+	build := func(fn statemachine.TaskFn) *statemachine.StateMachine {
+		return statemachine.NewStateMachineBuilder().
+			StartAt("Report").
+			AddTask("Report", fn, "Done", statemachine.WithHeartbeat(time.Second),
+				statemachine.CatchRule{ErrorName: statemachine.ErrorHeartbeatTimeout, NextState: "Stalled"}).
+			AddPass("Stalled", "Done", func(sc *statemachine.StateContext) { sc.Data["stalled"] = true }).
+			AddEnd("Done").
+			BuildOrDie()
+	}
+
+	t.Run("Heartbeats keep a long task alive", func(t *testing.T) {
+		sm := build(func(ctx context.Context, sc *statemachine.StateContext) error {
+			for i := 0; i < 6; i++ {
+				time.Sleep(300 * time.Millisecond)
+				statemachine.SendHeartbeat(ctx)
+			}
+			sc.Data["report"] = "ready"
+			return nil
+		})
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil || exec.Output()["report"] != "ready" {
+			t.Errorf("Expected the task to finish, got %v: %v", exec.Output(), err)
+		}
+	})
+
+	t.Run("A missed heartbeat fails the attempt", func(t *testing.T) {
+		sm := build(func(ctx context.Context, sc *statemachine.StateContext) error {
+			statemachine.SendHeartbeat(ctx)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil || exec.Output()["stalled"] != true {
+			t.Fatalf("Expected the heartbeat timeout to be caught, got %v: %v", exec.Output(), err)
+		}
+		failed := exec.History().Filter(statemachine.EventTaskAttemptFailed)
+		if len(failed) != 1 || !errors.Is(failed[0].Error, statemachine.ErrHeartbeatTimeout) {
+			t.Errorf("Expected the attempt to fail with ErrHeartbeatTimeout, got %+v", failed)
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		write := func(heartbeat, timeout int) string {
+			definition := fmt.Sprintf(`{
+				"StartAt": "Report",
+				"States": {
+					"Report": {
+						"Type": "Task", "HeartbeatSeconds": %d, "TimeoutSeconds": %d,
+						"Catch": [{"ErrorEquals": ["States.Timeout"], "Next": "Done"}],
+						"Next": "Done"
+					},
+					"Done": {"Type": "End"}
+				}
+			}`, heartbeat, timeout)
+			return writeDefinition(t, definition)
+		}
+		silent := map[string]statemachine.TaskFn{"Report": func(ctx context.Context, sc *statemachine.StateContext) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+
+		if _, err := statemachine.ParseStateMachine(write(5, 5), silent); err == nil {
+			t.Error("Expected HeartbeatSeconds >= TimeoutSeconds to be rejected")
+		}
+		sm, err := statemachine.ParseStateMachine(write(1, 10), silent)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		started := time.Now()
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil || time.Since(started) > 5*time.Second {
+			t.Errorf("Expected States.Timeout to catch the heartbeat timeout quickly, got %v after %v", err, time.Since(started))
+		}
+		if caught := exec.History().Filter(statemachine.EventErrorCaught); len(caught) != 1 {
+			t.Errorf("Expected the heartbeat timeout to be caught, got %+v", caught)
+		}
+	})
+}
+
+func TestSubSecondTimeouts(t *testing.T) {
+	slow := func(ctx context.Context, sc *statemachine.StateContext) error {
+		select {
+		case <-time.After(time.Second):
+			sc.Data["finished"] = true
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	timedOut := func(t *testing.T, exec *statemachine.Execution, err error, started time.Time) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Expected the timeout to be caught, got %v", err)
+		}
+		if _, ok := exec.Output()["finished"]; ok || time.Since(started) > 500*time.Millisecond {
+			t.Errorf("Expected a sub-second timeout, got %v after %v", exec.Output(), time.Since(started))
+		}
+	}
+
+	t.Run("Builder durations", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Pause").
+			AddWaitDuration("Pause", 20*time.Millisecond, "Call").
+			AddTask("Call", slow, "Done", statemachine.WithTimeout(50*time.Millisecond),
+				statemachine.CatchRule{ErrorName: statemachine.ErrorTimeout, NextState: "Done"}).
+			AddEnd("Done").
+			BuildOrDie()
+
+		started := time.Now()
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		timedOut(t, exec, err, started)
+		entered := exec.History().State("Pause")
+		if waited := entered[len(entered)-1].Duration; waited < 20*time.Millisecond || waited > 500*time.Millisecond {
+			t.Errorf("Expected the wait state to wait about 20ms, got %v", waited)
+		}
+
+		_, err = statemachine.NewStateMachineBuilder().
+			StartAt("Pause").
+			AddWaitDuration("Pause", -time.Second, "Done").
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Error("Expected a negative wait duration to be rejected")
+		}
+	})
+
+	write := func(t *testing.T, task string) string {
+		definition := `{
+			"StartAt": "Pause",
+			"States": {
+				"Pause": {"Type": "Wait", "Seconds": 0.02, "Next": "Call"},
+				"Call": {
+					"Type": "Task", ` + task + `,
+					"Catch": [{"ErrorEquals": ["States.Timeout"], "Next": "Done"}],
+					"Next": "Done"
+				},
+				"Done": {"Type": "End"}
+			}
+		}`
+		return writeDefinition(t, definition)
+	}
+	tasks := map[string]statemachine.TaskFn{"Call": slow}
+
+	for _, task := range []string{`"TimeoutSeconds": 0.05`, `"TimeoutMilliseconds": 50`, `"TimeoutSecondsPath": "$.budget"`} {
+		t.Run("JSON "+task, func(t *testing.T) {
+			sm, err := statemachine.ParseStateMachine(write(t, task), tasks)
+			if err != nil {
+				t.Fatalf("Failed to parse JSON: %v", err)
+			}
+			started := time.Now()
+			exec, err := sm.Run(context.Background(), map[string]any{"budget": 0.05})
+			timedOut(t, exec, err, started)
+		})
+	}
+
+	t.Run("TimeoutSecondsPath is read at runtime", func(t *testing.T) {
+		sm, err := statemachine.ParseStateMachine(write(t, `"TimeoutSecondsPath": "$.budget"`), tasks)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		exec, err := sm.Run(context.Background(), map[string]any{"budget": 5})
+		if err != nil || exec.Output()["finished"] != true {
+			t.Errorf("Expected the task to finish within its budget, got %v: %v", exec.Output(), err)
+		}
+		if _, err := sm.Run(context.Background(), map[string]any{"budget": "soon"}); err == nil {
+			t.Error("Expected a non-numeric budget to fail the execution")
+		}
+	})
+
+	t.Run("Conflicting timeouts are rejected", func(t *testing.T) {
+		if _, err := statemachine.ParseStateMachine(write(t, `"TimeoutSeconds": 1, "TimeoutMilliseconds": 50`), tasks); err == nil {
+			t.Error("Expected TimeoutSeconds and TimeoutMilliseconds together to be rejected")
+		}
+	})
+}
+
+func TestExecutionTimeout(t *testing.T) {
+	expectTimedOut := func(t *testing.T, exec *statemachine.Execution, err error, state string) {
+		t.Helper()
+		if !errors.Is(err, statemachine.ErrExecutionTimeout) || exec.Status() != statemachine.ExecutionTimedOut {
+			t.Fatalf("Expected the execution to time out, got %s: %v", exec.Status(), err)
+		}
+		timedOut := exec.History().Filter(statemachine.EventExecutionTimedOut)
+		if len(timedOut) != 1 || timedOut[0].StateName != state || exec.CurrentState() != state {
+			t.Errorf("Expected the timeout to be reported in state %s, got %+v", state, timedOut)
+		}
+	}
+
+	t.Run("Builder", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Fast").
+			Timeout(300*time.Millisecond).
+			AddPass("Fast", "Slow", nil).
+			AddTask("Slow", testTasks["TestTimeoutTask"], "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		started := time.Now()
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		expectTimedOut(t, exec, err, "Slow")
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Errorf("Expected the execution to stop at its deadline, took %v", elapsed)
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		definition := `{
+			"StartAt": "Pause",
+			"TimeoutSeconds": 0.2,
+			"States": {
+				"Pause": {"Type": "Wait", "Seconds": 5, "Next": "Done"},
+				"Done": {"Type": "End"}
+			}
+		}`
+		sm, err := statemachine.ParseStateMachine(writeDefinition(t, definition), nil)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		expectTimedOut(t, exec, err, "Pause")
+	})
+
+	t.Run("Catch rules do not catch the deadline", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Slow").
+			Timeout(300*time.Millisecond).
+			AddTask("Slow", testTasks["TestTimeoutTask"], "Done",
+				statemachine.RetryRule{ErrorName: statemachine.ErrorAll, MaxAttempts: 3},
+				statemachine.CatchRule{ErrorName: statemachine.ErrorAll, NextState: "Cleanup", ResultPath: "$.error"}).
+			AddPass("Cleanup", "Done", nil).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		expectTimedOut(t, exec, err, "Slow")
+		if caught := exec.History().Filter(statemachine.EventErrorCaught); len(caught) != 0 {
+			t.Errorf("Expected the deadline not to be caught, got %+v", caught)
+		}
+		if retries := exec.History().Filter(statemachine.EventRetryScheduled); len(retries) != 0 {
+			t.Errorf("Expected the deadline not to be retried, got %+v", retries)
+		}
+
+		fan, err := statemachine.NewStateMachineBuilder().
+			StartAt("Fan").
+			Timeout(300*time.Millisecond).
+			AddMap("Fan", "items", "results", statemachine.NewStateMachineBuilder().
+				StartAt("Slow").
+				AddTask("Slow", testTasks["TestTimeoutTask"], "", statemachine.AsEnd()).
+				BuildOrDie(), "Done",
+				statemachine.CatchRule{ErrorName: statemachine.ErrorAll, NextState: "Cleanup"}).
+			AddPass("Cleanup", "Done", nil).
+			AddEnd("Done").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exec, err = fan.Run(context.Background(), map[string]any{"items": []any{1, 2}})
+		expectTimedOut(t, exec, err, "Fan")
+	})
+
+	t.Run("Cancelling the context still aborts", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Slow").
+			Timeout(time.Minute).
+			AddTask("Slow", testTasks["TestTimeoutTask"], "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		exec, _ := sm.Run(ctx, map[string]any{})
+		if exec.Status() != statemachine.ExecutionAborted {
+			t.Errorf("Expected status %s, got %s", statemachine.ExecutionAborted, exec.Status())
+		}
+	})
+}
+
+func TestBuilderOptions(t *testing.T) {
+	t.Run("Typed options configure the state", func(t *testing.T) {
+		calls := 0
+		flaky := func(ctx context.Context, sc *statemachine.StateContext) error {
+			calls++
+			if calls < 2 {
+				return statemachine.ErrAPIBadGateway
+			}
+			sc.Data["total"] = float64(42)
+			return nil
+		}
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Call").
+			AddTask("Call", flaky, "Unreachable",
+				statemachine.WithRetry(statemachine.RetryRule{ErrorName: "API_BAD_GATEWAY", MaxAttempts: 2}),
+				statemachine.WithTimeout(time.Second),
+				statemachine.WithResultSelector(map[string]any{"amount.$": "$.total"}),
+				statemachine.WithResultPath("$.invoice"),
+				statemachine.AsEnd()).
+			AddFail("Unreachable").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil {
+			t.Fatalf("Expected the execution to succeed, got %v", err)
+		}
+		invoice, _ := exec.Output()["invoice"].(map[string]any)
+		if invoice["amount"] != float64(42) || calls != 2 {
+			t.Errorf("Expected one retry and the selected result, got %d calls and %v", calls, exec.Output())
+		}
+	})
+
+	t.Run("Options that do not apply fail Build", func(t *testing.T) {
+		_, err := statemachine.NewStateMachineBuilder().
+			StartAt("Select").
+			AddPass("Select", "Pause", nil, statemachine.WithRetry(statemachine.RetryRule{MaxAttempts: 1})).
+			AddWait("Pause", 0, "Done", statemachine.WithHeartbeat(time.Second)).
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Fatal("Expected Build to reject options that do not apply")
+		}
+		for _, want := range []string{"state 'Select': WithRetry", "state 'Pause': WithHeartbeat"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Expected %q in %v", want, err)
+			}
+		}
+	})
+
+	t.Run("Choice and Wait states only take InputPath and OutputPath", func(t *testing.T) {
+		_, err := statemachine.NewStateMachineBuilder().
+			StartAt("Pause").
+			AddWait("Pause", 0, "Route", statemachine.WithInputPath("$.order"), statemachine.WithResultPath("$.x")).
+			AddChoice("Route", nil, "Done", statemachine.WithOutputPath("$"),
+				statemachine.WithParameters(map[string]any{"a": 1}), statemachine.WithResultSelector(map[string]any{"b": 2})).
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Fatal("Expected Build to reject data flow fields that Choice and Wait states ignore")
+		}
+		for _, want := range []string{"state 'Pause': WithResultPath", "state 'Route': WithParameters", "state 'Route': WithResultSelector"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Expected %q in %v", want, err)
+			}
+		}
+	})
+}
+
+func TestMapMaxConcurrency(t *testing.T) {
+	// track records the highest number of iterations running at once.
+	var running, peak atomic.Int64
+	track := func(ctx context.Context, sc *statemachine.StateContext) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	items := make([]any, 8)
+	for i := range items {
+		items[i] = i
+	}
+	branch := statemachine.NewStateMachineBuilder().
+		StartAt("Track").
+		AddTask("Track", track, "", statemachine.AsEnd()).
+		BuildOrDie()
+
+	t.Run("Builder", func(t *testing.T) {
+		peak.Store(0)
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Process").
+			AddMap("Process", "items", "results", branch, "Done", statemachine.WithMaxConcurrency(2)).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{"items": items})
+		if err != nil {
+			t.Fatalf("Expected the execution to succeed, got %v", err)
+		}
+		if results, _ := exec.Output()["results"].([]any); len(results) != len(items) {
+			t.Errorf("Expected %d results, got %v", len(items), exec.Output()["results"])
+		}
+		if p := peak.Load(); p != 2 {
+			t.Errorf("Expected at most 2 iterations at once, got %d", p)
+		}
+		started := exec.History().Filter(statemachine.EventMapIterationStarted)
+		for _, event := range started {
+			if event.InFlight < 1 || event.InFlight > 2 || event.Queued < 0 || event.Queued > len(items)-1 {
+				t.Errorf("Unexpected counts in %s: in flight %d, queued %d", event.Type, event.InFlight, event.Queued)
+			}
+		}
+		if first := started[0]; first.Queued != len(items)-1 {
+			t.Errorf("Expected %d queued items after the first start, got %d", len(items)-1, first.Queued)
+		}
+		finished := exec.History().Filter(statemachine.EventMapIterationSucceeded)
+		if last := finished[len(finished)-1]; last.InFlight != 0 || last.Queued != 0 {
+			t.Errorf("Expected nothing in flight or queued after the last iteration, got %d and %d", last.InFlight, last.Queued)
+		}
+	})
+
+	write := func(t *testing.T, maxConcurrency int) string {
+		definition := fmt.Sprintf(`{
+			"StartAt": "Process",
+			"States": {
+				"Process": {
+					"Type": "Map",
+					"ItemsPath": "$.items",
+					"MaxConcurrency": %d,
+					"ResultPath": "$.results",
+					"Iterator": {
+						"StartAt": "Track",
+						"States": {"Track": {"Type": "Task", "End": true}}
+					},
+					"Next": "Done"
+				},
+				"Done": {"Type": "End"}
+			}
+		}`, maxConcurrency)
+		return writeDefinition(t, definition)
+	}
+
+	t.Run("JSON definition", func(t *testing.T) {
+		peak.Store(0)
+		sm, err := statemachine.ParseStateMachine(write(t, 3), map[string]statemachine.TaskFn{"Track": track})
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		if _, err := sm.Run(context.Background(), map[string]any{"items": items}); err != nil {
+			t.Fatalf("Expected the execution to succeed, got %v", err)
+		}
+		if p := peak.Load(); p != 3 {
+			t.Errorf("Expected at most 3 iterations at once, got %d", p)
+		}
+
+		if _, err := statemachine.ParseStateMachine(write(t, -1), map[string]statemachine.TaskFn{"Track": track}); err == nil {
+			t.Error("Expected a negative MaxConcurrency to be rejected")
+		}
+	})
+}
+
+func TestMapToleratedFailures(t *testing.T) {
+	// Items divisible by three fail, which is two of the six items.
+	check := func(ctx context.Context, sc *statemachine.StateContext) error {
+		if sc.Data["item"].(int)%3 == 0 {
+			return statemachine.ErrAPIBadGateway
+		}
+		sc.Data["checked"] = true
+		return nil
+	}
+	branch := statemachine.NewStateMachineBuilder().
+		StartAt("Check").
+		AddTask("Check", check, "", statemachine.AsEnd()).
+		BuildOrDie()
+	items := []any{0, 1, 2, 3, 4, 5}
+
+	run := func(t *testing.T, options ...statemachine.StateOption) *statemachine.Execution {
+		t.Helper()
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Import").
+			AddMap("Import", "items", "results", branch, "Done", options...).
+			AddPass("TooManyFailures", "Done", nil).
+			AddEnd("Done").
+			BuildOrDie()
+		exec, _ := sm.Run(context.Background(), map[string]any{"items": items})
+		return exec
+	}
+	thresholdCatch := statemachine.CatchRule{ErrorName: statemachine.ErrorExceedToleratedFailureThreshold, NextState: "TooManyFailures"}
+
+	t.Run("Failures within the threshold are recorded per item", func(t *testing.T) {
+		for _, option := range []statemachine.StateOption{
+			statemachine.WithToleratedFailureCount(2),
+			statemachine.WithToleratedFailurePercentage(40),
+		} {
+			exec := run(t, option, thresholdCatch)
+			if exec.Status() != statemachine.ExecutionSucceeded || len(exec.History().Filter(statemachine.EventErrorCaught)) != 0 {
+				t.Fatalf("Expected the failures to be tolerated, got %s: %v", exec.Status(), exec.Err())
+			}
+			results := exec.Output()["results"].([]any)
+			failed, _ := results[3].(map[string]any)
+			if failed["Error"] != "API_BAD_GATEWAY" || !strings.Contains(failed["Cause"].(string), "api service is unavailable") {
+				t.Errorf("Expected the error output of item 3, got %v", results[3])
+			}
+			if succeeded, _ := results[1].(map[string]any); succeeded["checked"] != true {
+				t.Errorf("Expected the output of item 1, got %v", results[1])
+			}
+		}
+	})
+
+	t.Run("Exceeding the threshold fails the state", func(t *testing.T) {
+		for _, option := range []statemachine.StateOption{
+			statemachine.WithToleratedFailureCount(1),
+			statemachine.WithToleratedFailurePercentage(30),
+		} {
+			exec := run(t, option, thresholdCatch)
+			caught := exec.History().Filter(statemachine.EventErrorCaught)
+			if len(caught) != 1 || !errors.Is(caught[0].Error, statemachine.ErrToleratedFailureThreshold) {
+				t.Errorf("Expected %s to be caught, got %+v", statemachine.ErrorExceedToleratedFailureThreshold, caught)
+			}
+		}
+	})
+
+	t.Run("Without a threshold any failure fails the state", func(t *testing.T) {
+		exec := run(t)
+		if exec.Status() != statemachine.ExecutionFailed || !errors.Is(exec.Err(), statemachine.ErrAPIBadGateway) {
+			t.Errorf("Expected the iteration error to fail the execution, got %s: %v", exec.Status(), exec.Err())
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		write := func(t *testing.T, tolerance string) string {
+			definition := `{
+				"StartAt": "Import",
+				"States": {
+					"Import": {
+						"Type": "Map",
+						"ItemsPath": "$.items",
+						` + tolerance + `,
+						"ResultPath": "$.results",
+						"Iterator": {
+							"StartAt": "Check",
+							"States": {"Check": {"Type": "Task", "End": true}}
+						},
+						"Next": "Done"
+					},
+					"Done": {"Type": "End"}
+				}
+			}`
+			return writeDefinition(t, definition)
+		}
+		tasks := map[string]statemachine.TaskFn{"Check": check}
+
+		sm, err := statemachine.ParseStateMachine(write(t, `"ToleratedFailureCount": 2`), tasks)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		if _, err := sm.Run(context.Background(), map[string]any{"items": items}); err != nil {
+			t.Errorf("Expected the failures to be tolerated, got %v", err)
+		}
+		if _, err := statemachine.ParseStateMachine(write(t, `"ToleratedFailurePercentage": 150`), tasks); err == nil {
+			t.Error("Expected a percentage above 100 to be rejected")
+		}
+	})
+}
+
+func TestMapItemSelector(t *testing.T) {
+	// label records what each iteration received from the ItemSelector.
+	label := func(ctx context.Context, sc *statemachine.StateContext) error {
+		sc.Data["label"] = fmt.Sprintf("%v/%v/%v", sc.Data["tenant"], sc.Data["index"], sc.Data["sku"])
+		return nil
+	}
+	branch := statemachine.NewStateMachineBuilder().
+		StartAt("Label").
+		AddTask("Label", label, "", statemachine.AsEnd()).
+		BuildOrDie()
+	input := map[string]any{
+		"tenant": "acme",
+		"order":  map[string]any{"items": []any{map[string]any{"sku": "a"}, map[string]any{"sku": "b"}}},
+	}
+	selector := map[string]any{
+		"tenant.$": "$.tenant",
+		"index.$":  "$$.Map.Item.Index",
+		"sku.$":    "$$.Map.Item.Value.sku",
+	}
+	expectLabels := func(t *testing.T, exec *statemachine.Execution, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Expected the execution to succeed, got %v", err)
+		}
+		results, _ := exec.Output()["labels"].([]any)
+		if len(results) != 2 {
+			t.Fatalf("Expected two results, got %v", exec.Output()["labels"])
+		}
+		for i, want := range []string{"acme/0/a", "acme/1/b"} {
+			if got := results[i].(map[string]any)["label"]; got != want {
+				t.Errorf("Expected label %q for item %d, got %v", want, i, got)
+			}
+		}
+	}
+
+	t.Run("Builder", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Label").
+			AddMap("Label", "$.order.items", "labels", branch, "Done", statemachine.WithItemSelector(selector)).
+			AddEnd("Done").
+			BuildOrDie()
+		exec, err := sm.Run(context.Background(), input)
+		expectLabels(t, exec, err)
+	})
+
+	t.Run("Both ItemSelector and Parameters are rejected", func(t *testing.T) {
+		_, err := statemachine.NewStateMachineBuilder().
+			StartAt("Label").
+			AddMap("Label", "$.order.items", "labels", branch, "Done",
+				statemachine.WithItemSelector(selector), statemachine.WithParameters(selector)).
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Error("Expected ItemSelector together with Parameters to be rejected")
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		for _, field := range []string{"ItemSelector", "Parameters"} {
+			definition := `{
+				"StartAt": "Label",
+				"States": {
+					"Label": {
+						"Type": "Map",
+						"ItemsPath": "$.order.items",
+						"` + field + `": {
+							"tenant.$": "$.tenant",
+							"index.$": "$$.Map.Item.Index",
+							"sku.$": "$$.Map.Item.Value.sku"
+						},
+						"ResultPath": "$.labels",
+						"Iterator": {
+							"StartAt": "Label",
+							"States": {"Label": {"Type": "Task", "End": true}}
+						},
+						"Next": "Done"
+					},
+					"Done": {"Type": "End"}
+				}
+			}`
+			sm, err := statemachine.ParseStateMachine(writeDefinition(t, definition), map[string]statemachine.TaskFn{"Label": label})
+			if err != nil {
+				t.Fatalf("Failed to parse JSON with %s: %v", field, err)
+			}
+			exec, err := sm.Run(context.Background(), input)
+			expectLabels(t, exec, err)
+		}
+	})
+}
+
+func TestFailFast(t *testing.T) {
+	// slowOrFail fails for item 0, once its siblings had time to start, and
+	// otherwise runs until it is cancelled.
+	slowOrFail := func(ctx context.Context, sc *statemachine.StateContext) error {
+		if item, _ := sc.Data["item"].(int); item == 0 {
+			time.Sleep(100 * time.Millisecond)
+			return statemachine.ErrAPIBadGateway
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+	branchOf := func(fn statemachine.TaskFn) *statemachine.StateMachine {
+		return statemachine.NewStateMachineBuilder().
+			StartAt("Work").
+			AddTask("Work", fn, "", statemachine.AsEnd()).
+			BuildOrDie()
+	}
+	expectFailedFast := func(t *testing.T, exec *statemachine.Execution, err error, started time.Time) {
+		t.Helper()
+		if !errors.Is(err, statemachine.ErrAPIBadGateway) {
+			t.Errorf("Expected the failure of the failing sibling, got %v", err)
+		}
+		if errors.Is(err, context.Canceled) {
+			t.Errorf("Expected cancelled siblings not to be reported, got %v", err)
+		}
+		if elapsed := time.Since(started); elapsed > 2*time.Second {
+			t.Errorf("Expected the siblings to be cancelled, took %v", elapsed)
+		}
+	}
+
+	t.Run("Map iterations", func(t *testing.T) {
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Process").
+			AddMap("Process", "items", "results", branchOf(slowOrFail), "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		started := time.Now()
+		exec, err := sm.Run(context.Background(), map[string]any{"items": []any{0, 1, 2}})
+		expectFailedFast(t, exec, err, started)
+		if failed := exec.History().Filter(statemachine.EventMapIterationFailed); len(failed) != 3 {
+			t.Errorf("Expected every iteration to stop before the state failed, got %d failed iterations", len(failed))
+		}
+	})
+
+	t.Run("Parallel branches", func(t *testing.T) {
+		failing := func(ctx context.Context, sc *statemachine.StateContext) error {
+			return statemachine.ErrAPIBadGateway
+		}
+		slow := func(ctx context.Context, sc *statemachine.StateContext) error {
+			sc.Data["item"] = 1
+			return slowOrFail(ctx, sc)
+		}
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Fork").
+			AddParallel("Fork", []*statemachine.StateMachine{branchOf(slow), branchOf(failing)}, "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		started := time.Now()
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		expectFailedFast(t, exec, err, started)
+		if failed := exec.History().Filter(statemachine.EventParallelBranchFailed); len(failed) != 2 {
+			t.Errorf("Expected both branches to stop before the state failed, got %d failed branches", len(failed))
+		}
+	})
+
+	t.Run("Cancelled siblings are not retried or caught", func(t *testing.T) {
+		slow := func(ctx context.Context, sc *statemachine.StateContext) error {
+			sc.Data["item"] = 1
+			return slowOrFail(ctx, sc)
+		}
+		guarded := statemachine.NewStateMachineBuilder().
+			StartAt("Work").
+			AddTask("Work", slow, "", statemachine.AsEnd(),
+				statemachine.RetryRule{ErrorEquals: []string{statemachine.ErrorAll}, Interval: time.Millisecond, MaxAttempts: 3},
+				statemachine.CatchRule{ErrorEquals: []string{statemachine.ErrorAll}, NextState: "Cleanup", ResultPath: "$.error"}).
+			AddPass("Cleanup", "Done", nil).
+			AddEnd("Done").
+			BuildOrDie()
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Fork").
+			AddParallel("Fork", []*statemachine.StateMachine{guarded, branchOf(slowOrFail)}, "Done").
+			AddEnd("Done").
+			BuildOrDie()
+
+		started := time.Now()
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		expectFailedFast(t, exec, err, started)
+		for _, branch := range exec.History().Filter(statemachine.EventParallelBranchFailed) {
+			if handled := branch.Nested.Filter(statemachine.EventRetryScheduled, statemachine.EventErrorCaught); len(handled) > 0 {
+				t.Errorf("Expected the cancelled branch not to retry or catch, got %+v", handled)
+			}
+			if entered := branch.Nested.State("Cleanup"); len(entered) > 0 {
+				t.Errorf("Expected the cancelled branch to stop in Work, got %+v", entered)
+			}
+		}
+	})
+
+	t.Run("All failures are reported and queued items skipped", func(t *testing.T) {
+		failing := func(ctx context.Context, sc *statemachine.StateContext) error {
+			return fmt.Errorf("item %v: %w", sc.Data["item"], statemachine.ErrAPIBadGateway)
+		}
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Process").
+			AddMap("Process", "items", "results", branchOf(failing), "Done",
+				statemachine.WithMaxConcurrency(1), statemachine.WithToleratedFailureCount(1)).
+			AddEnd("Done").
+			BuildOrDie()
+
+		exec, err := sm.Run(context.Background(), map[string]any{"items": []any{0, 1, 2, 3}})
+		if !errors.Is(err, statemachine.ErrToleratedFailureThreshold) {
+			t.Fatalf("Expected the threshold to be exceeded, got %v", err)
+		}
+		for _, want := range []string{"map iteration 0 failed", "map iteration 1 failed"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Expected %q in %v", want, err)
+			}
+		}
+		if started := exec.History().Filter(statemachine.EventMapIterationStarted); len(started) != 2 {
+			t.Errorf("Expected the items after the second failure to be skipped, got %d started iterations", len(started))
+		}
+	})
+}
+
+func TestMapItemReader(t *testing.T) {
+	branch := statemachine.NewStateMachineBuilder().
+		StartAt("Import").
+		AddPass("Import", "Done", nil).
+		AddEnd("Done").
+		BuildOrDie()
+	write := func(t *testing.T, name, content string) string {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// importItems runs a Map state over the items of reader and returns them.
+	importItems := func(t *testing.T, reader statemachine.ItemReader) ([]any, error) {
+		t.Helper()
+		sm := statemachine.NewStateMachineBuilder().
+			StartAt("Import").
+			AddMap("Import", "", "imported", branch, "Done",
+				statemachine.WithItemReader(reader), statemachine.WithMaxConcurrency(2)).
+			AddEnd("Done").
+			BuildOrDie()
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil {
+			return nil, err
+		}
+		var items []any
+		for _, result := range exec.Output()["imported"].([]any) {
+			items = append(items, result.(map[string]any)["item"])
+		}
+		return items, nil
+	}
+	expectItems := func(t *testing.T, got []any, err error, want []any) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Expected the items to be imported, got %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Expected items %v, got %v", want, got)
+		}
+	}
+
+	t.Run("JSON array", func(t *testing.T) {
+		path := write(t, "items.json", `[{"sku": "a"}, {"sku": "b"}, {"sku": "c"}]`)
+		items, err := importItems(t, statemachine.ItemReader{Path: path, ReaderConfig: statemachine.ItemReaderConfig{InputType: statemachine.InputTypeJSON}})
+		expectItems(t, items, err, []any{
+			map[string]any{"sku": "a"}, map[string]any{"sku": "b"}, map[string]any{"sku": "c"},
+		})
+	})
+
+	t.Run("JSON Lines stop at MaxItems", func(t *testing.T) {
+		// The malformed last line is never read.
+		path := write(t, "items.jsonl", "1\n\n2\n3\nnot json\n")
+		items, err := importItems(t, statemachine.ItemReader{Path: path, ReaderConfig: statemachine.ItemReaderConfig{InputType: statemachine.InputTypeJSONL, MaxItems: 3}})
+		expectItems(t, items, err, []any{float64(1), float64(2), float64(3)})
+	})
+
+	t.Run("CSV headers", func(t *testing.T) {
+		path := write(t, "first_row.csv", "\ufeffsku,qty\na,1\nb,2\n")
+		items, err := importItems(t, statemachine.ItemReader{Path: path, ReaderConfig: statemachine.ItemReaderConfig{InputType: statemachine.InputTypeCSV}})
+		expectItems(t, items, err, []any{
+			map[string]any{"sku": "a", "qty": "1"}, map[string]any{"sku": "b", "qty": "2"},
+		})
+
+		path = write(t, "given.csv", "a,1\nb,2\n")
+		items, err = importItems(t, statemachine.ItemReader{Path: path, ReaderConfig: statemachine.ItemReaderConfig{
+			InputType:         statemachine.InputTypeCSV,
+			CSVHeaderLocation: statemachine.CSVHeaderGiven,
+			CSVHeaders:        []string{"sku", "qty"},
+		}})
+		expectItems(t, items, err, []any{
+			map[string]any{"sku": "a", "qty": "1"}, map[string]any{"sku": "b", "qty": "2"},
+		})
+	})
+
+	t.Run("Malformed files fail the state", func(t *testing.T) {
+		path := write(t, "short_row.csv", "sku,qty\na,1\nb\n")
+		_, err := importItems(t, statemachine.ItemReader{Path: path, ReaderConfig: statemachine.ItemReaderConfig{InputType: statemachine.InputTypeCSV}})
+		if err == nil || !strings.Contains(err.Error(), "ItemReader") {
+			t.Errorf("Expected an ItemReader error, got %v", err)
+		}
+		_, err = importItems(t, statemachine.ItemReader{Path: filepath.Join(t.TempDir(), "missing.json"), ReaderConfig: statemachine.ItemReaderConfig{InputType: statemachine.InputTypeJSON}})
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected a missing file to fail the state, got %v", err)
+		}
+	})
+
+	t.Run("JSON definition", func(t *testing.T) {
+		items := write(t, "items.csv", "sku\na\nb\nc\n")
+		definition := func(readerConfig string) string {
+			return writeDefinition(t, `{
+				"StartAt": "Import",
+				"States": {
+					"Import": {
+						"Type": "Map",
+						"ItemReader": {
+							"Path": "`+filepath.ToSlash(items)+`",
+							"ReaderConfig": `+readerConfig+`
+						},
+						"MaxConcurrency": 4,
+						"ResultPath": "$.imported",
+						"Iterator": {
+							"StartAt": "Pass",
+							"States": {"Pass": {"Type": "Pass", "Next": "Done"}, "Done": {"Type": "End"}}
+						},
+						"Next": "Done"
+					},
+					"Done": {"Type": "End"}
+				}
+			}`)
+		}
+
+		sm, err := statemachine.ParseStateMachine(definition(`{"InputType": "CSV", "CSVHeaderLocation": "FIRST_ROW", "MaxItems": 2}`), nil)
+		if err != nil {
+			t.Fatalf("Failed to parse JSON: %v", err)
+		}
+		exec, err := sm.Run(context.Background(), map[string]any{})
+		if err != nil {
+			t.Fatalf("Expected the items to be imported, got %v", err)
+		}
+		if imported := exec.Output()["imported"].([]any); len(imported) != 2 {
+			t.Errorf("Expected MaxItems to limit the items to 2, got %v", imported)
+		}
+
+		if _, err := statemachine.ParseStateMachine(definition(`{"InputType": "CSV", "CSVHeaderLocation": "GIVEN"}`), nil); err == nil {
+			t.Error("Expected GIVEN headers without CSVHeaders to be rejected")
+		}
+
+		_, err = statemachine.NewStateMachineBuilder().
+			StartAt("Import").
+			AddMap("Import", "", "imported", branch, "Done", statemachine.WithItemReader(statemachine.ItemReader{
+				Path:         items,
+				ReaderConfig: statemachine.ItemReaderConfig{InputType: statemachine.InputTypeCSV},
+			})).
+			AddEnd("Done").
+			Build()
+		if err == nil {
+			t.Error("Expected an ItemReader without MaxConcurrency to be rejected")
 		}
 	})
 }
@@ -1,11 +1,20 @@
 package statemachine
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+)
 
 // StateMachineBuilder provides a fluent API for defining the state machine.
 type StateMachineBuilder struct {
 	states  map[string]State
 	startAt string
+	timeout time.Duration
+	// errs holds the options that did not apply to their state.
+	errs []error
 }
 
 func NewStateMachineBuilder() *StateMachineBuilder {
@@ -19,45 +28,66 @@ func (b *StateMachineBuilder) StartAt(name string) *StateMachineBuilder {
 	return b
 }
 
-func (b *StateMachineBuilder) AddTask(name string, fn TaskFn, nextState string, options ...any) *StateMachineBuilder {
-	task := &TaskState{name: name, execute: fn, next: nextState}
-	for _, opt := range options {
-		if retry, ok := opt.(RetryRule); ok {
-			task.retries = append(task.retries, retry)
-		} else if catch, ok := opt.(CatchRule); ok {
-			task.catches = append(task.catches, catch)
-		} else if timeout, ok := opt.(int); ok {
-			task.TimeoutSeconds = timeout
-		} else if end, ok := opt.(bool); ok && end {
-			task.end = true
-		}
-	}
-	b.states[name] = task
+// Timeout limits how long an execution may run. An execution that runs
+// longer stops with status TIMED_OUT and ErrExecutionTimeout.
+func (b *StateMachineBuilder) Timeout(timeout time.Duration) *StateMachineBuilder {
+	b.timeout = timeout
 	return b
 }
 
-func (b *StateMachineBuilder) AddPass(name string, nextState string, modifier func(sc *StateContext)) *StateMachineBuilder {
-	b.states[name] = &PassState{name: name, next: nextState, modifier: modifier}
-	return b
+// AddTask adds a Task state that runs fn. Retry and catch rules, timeouts,
+// heartbeats and data flow are set with options.
+func (b *StateMachineBuilder) AddTask(name string, fn TaskFn, nextState string, options ...StateOption) *StateMachineBuilder {
+	return b.add(&TaskState{name: name, execute: fn, next: nextState}, options)
 }
 
-func (b *StateMachineBuilder) AddMap(name string, inputKey, resultKey string, branch *StateMachine, nextState string) *StateMachineBuilder {
-	b.states[name] = &MapState{name: name, input: inputKey, result: resultKey, branch: branch, next: nextState}
-	return b
+func (b *StateMachineBuilder) AddPass(name string, nextState string, modifier func(sc *StateContext), options ...StateOption) *StateMachineBuilder {
+	return b.add(&PassState{name: name, next: nextState, modifier: modifier}, options)
 }
 
-func (b *StateMachineBuilder) AddChoice(name string, choices []ChoiceRule, defaultState string) *StateMachineBuilder {
-	b.states[name] = &ChoiceState{name: name, choices: choices, defaultState: defaultState}
+// AddMap adds a Map state. inputKey and resultKey are either top-level keys or
+// paths; a ResultPath set through an option takes precedence over resultKey.
+// inputKey can be empty if the items come from an ItemReader, and resultKey
+// defaults to "map_output".
+func (b *StateMachineBuilder) AddMap(name string, inputKey, resultKey string, branch *StateMachine, nextState string, options ...StateOption) *StateMachineBuilder {
+	state := &MapState{name: name, itemsPath: keyPath(inputKey), branch: branch, next: nextState}
+	b.add(state, options)
+	if state.dataFlow.ResultPath == "" {
+		state.dataFlow.ResultPath = keyPath(resultKey)
+	}
 	return b
 }
 
-func (b *StateMachineBuilder) AddWait(name string, seconds int, nextState string) *StateMachineBuilder {
-	b.states[name] = &WaitState{name: name, seconds: seconds, next: nextState}
-	return b
+func (b *StateMachineBuilder) AddChoice(name string, choices []ChoiceRule, defaultState string, options ...StateOption) *StateMachineBuilder {
+	return b.add(&ChoiceState{name: name, choices: choices, defaultState: defaultState}, options)
+}
+
+// AddWait adds a state that waits for the given number of seconds.
+func (b *StateMachineBuilder) AddWait(name string, seconds int, nextState string, options ...StateOption) *StateMachineBuilder {
+	return b.AddWaitDuration(name, time.Duration(seconds)*time.Second, nextState, options...)
+}
+
+// AddWaitDuration adds a state that waits for the given duration.
+func (b *StateMachineBuilder) AddWaitDuration(name string, duration time.Duration, nextState string, options ...StateOption) *StateMachineBuilder {
+	return b.add(&WaitState{name: name, duration: duration, next: nextState}, options)
+}
+
+func (b *StateMachineBuilder) AddParallel(name string, branches []*StateMachine, nextState string, options ...StateOption) *StateMachineBuilder {
+	return b.add(&ParallelState{name: name, branches: branches, next: nextState}, options)
 }
 
-func (b *StateMachineBuilder) AddParallel(name string, branches []*StateMachine, nextState string) *StateMachineBuilder {
-	b.states[name] = &ParallelState{name: name, branches: branches, next: nextState}
+// add applies the options to state and adds it. Options that do not apply
+// to the state are reported by Build.
+func (b *StateMachineBuilder) add(state State, options []StateOption) *StateMachineBuilder {
+	for _, opt := range options {
+		if opt == nil {
+			continue
+		}
+		if err := opt.applyState(state); err != nil {
+			b.errs = append(b.errs, fmt.Errorf("state '%s': %w", state.GetName(), err))
+		}
+	}
+	b.states[state.GetName()] = state
 	return b
 }
 
@@ -71,15 +101,33 @@ func (b *StateMachineBuilder) AddEnd(name string) *StateMachineBuilder {
 	return b
 }
 
+// validator is implemented by the states that check their definition, so
+// that mistakes are reported by Build instead of when the state runs.
+type validator interface {
+	validate() error
+}
+
 func (b *StateMachineBuilder) Build() (*StateMachine, error) {
-	startState, ok := b.states[b.startAt]
-	if !ok {
+	if len(b.errs) > 0 {
+		return nil, errors.Join(b.errs...)
+	}
+	if _, ok := b.states[b.startAt]; !ok {
 		return nil, fmt.Errorf("start state '%s' not found", b.startAt)
 	}
+	for _, state := range b.states {
+		if v, ok := state.(validator); ok {
+			if err := v.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if b.timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
+	}
 	return &StateMachine{
-		states:       b.states,
-		currentState: startState,
-		startAt:      b.startAt,
+		states:  maps.Clone(b.states),
+		startAt: b.startAt,
+		timeout: b.timeout,
 	}, nil
 }
 
@@ -90,3 +138,11 @@ func (b *StateMachineBuilder) BuildOrDie() *StateMachine {
 	}
 	return sm
 }
+
+// keyPath turns a top-level key into a path. Values that already are paths are returned unchanged.
+func keyPath(key string) string {
+	if key == "" || strings.HasPrefix(key, "$") {
+		return key
+	}
+	return "$." + key
+}
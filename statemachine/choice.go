@@ -3,12 +3,14 @@ package statemachine
 import (
 	"context"
 	"fmt"
-	"strings"
 )
 
 // ChoiceRule defines a condition and the next state to transition to.
+// Variable is the path compared by leaf conditions that have no InputPath
+// of their own.
 type ChoiceRule struct {
-	Condition map[string]any
+	Variable  string
+	Condition Condition
 	Next      string
 }
 
@@ -17,6 +19,7 @@ type ChoiceState struct {
 	name         string
 	choices      []ChoiceRule
 	defaultState string
+	dataFlow     DataFlow
 }
 
 func (s *ChoiceState) GetName() string {
@@ -24,56 +27,145 @@ func (s *ChoiceState) GetName() string {
 }
 
 func (s *ChoiceState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("Executing ChoiceState: %s\n", s.name)
-	for _, rule := range s.choices {
-		if s.evaluateCondition(rule.Condition, sc) {
-			fmt.Printf("Condition met. Transitioning to %s\n", rule.Next)
+	input, err := s.dataFlow.filterInput(ctx, sc.Data)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.dataFlow.filterOutput(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	sc.Data = output
+
+	for i, rule := range s.choices {
+		matched, err := s.evaluateCondition(ctx, rule.Condition, rule.Variable, input)
+		if err != nil {
+			return nil, fmt.Errorf("choice rule %d: %w", i, err)
+		}
+		if matched {
+			LoggerFromContext(ctx).Debug("choice rule matched", "rule", i, "next", rule.Next)
 			return machine.GetState(rule.Next), nil
 		}
 	}
-	fmt.Printf("No conditions met. Transitioning to default state %s\n", s.defaultState)
+	LoggerFromContext(ctx).Debug("no choice rule matched", "next", s.defaultState)
 	return machine.GetState(s.defaultState), nil
 }
 
-func (s *ChoiceState) evaluateCondition(condition map[string]any, sc *StateContext) bool {
-	var inputValue any
+func (s *ChoiceState) evaluateCondition(ctx context.Context, condition Condition, variable string, input any) (bool, error) {
+	for _, combinator := range []string{"And", "Or", "Not"} {
+		if operand, ok := condition[combinator]; ok {
+			if len(condition) != 1 {
+				return false, fmt.Errorf("'%s' cannot be combined with other fields in the same condition", combinator)
+			}
+			return s.evaluateCombinator(ctx, combinator, operand, variable, input)
+		}
+	}
+
+	operator, operand, err := conditionOperator(condition)
+	if err != nil {
+		return false, err
+	}
+
+	// A condition's own InputPath takes precedence over the rule's Variable.
+	path, _ := condition["InputPath"].(string)
+	if path == "" {
+		path = variable
+	}
+	if path == "" {
+		return false, fmt.Errorf("condition does not reference a variable")
+	}
+
+	inputValue, err := getPath(ctx, input, path)
+	if operator == "IsPresent" {
+		expected, ok := operand.(bool)
+		if !ok {
+			return false, fmt.Errorf("IsPresent expects a boolean, got %T", operand)
+		}
+		return (err == nil) == expected, nil
+	}
+	if err != nil {
+		// Path not found, so the condition cannot be evaluated.
+		return false, err
+	}
+
+	// The "...Path" variants compare against another value from the input.
+	if base, ok := pathOperand(operator); ok {
+		path, ok := operand.(string)
+		if !ok {
+			return false, fmt.Errorf("%s expects a path, got %T", operator, operand)
+		}
+		if operand, err = getPath(ctx, input, path); err != nil {
+			return false, err
+		}
+		operator = base
+	}
+	return compare(operator, inputValue, operand)
+}
+
+// evaluateCombinator evaluates an And, Or or Not condition, short-circuiting
+// as soon as the outcome is known.
+func (s *ChoiceState) evaluateCombinator(ctx context.Context, combinator string, operand any, variable string, input any) (bool, error) {
+	if combinator == "Not" {
+		nested, ok := asCondition(operand)
+		if !ok {
+			return false, fmt.Errorf("Not expects a condition, got %T", operand)
+		}
+		matched, err := s.evaluateCondition(ctx, nested, variable, input)
+		return !matched, err
+	}
 
-	// First, try to get the input value from the "InputPath" field, if it exists (JSON case)
-	if path, okPath := condition["InputPath"].(string); okPath {
-		// Use a new variable for the `ok` from the map lookup to avoid shadowing
-		if val, okData := sc.Data[strings.TrimPrefix(path, "$.")]; okData {
-			inputValue = val
-		} else {
-			// Key from InputPath not found, so the condition cannot be evaluated.
-			return false
+	list, ok := operand.([]any)
+	if !ok || len(list) == 0 {
+		return false, fmt.Errorf("%s expects a non-empty list of conditions", combinator)
+	}
+	// And stops at the first false condition, Or at the first true one.
+	stopAt := combinator == "Or"
+	for i, item := range list {
+		nested, ok := asCondition(item)
+		if !ok {
+			return false, fmt.Errorf("%s condition %d is %T, not a condition", combinator, i, item)
 		}
-	} else {
-		// If InputPath is not found, assume it's the programmatic case
-		// and the key to check is `choice_value` as defined in the main function.
-		if val, okData := sc.Data["choice_value"]; okData {
-			inputValue = val
-		} else {
-			// Hardcoded key not found, return false.
-			return false
+		matched, err := s.evaluateCondition(ctx, nested, variable, input)
+		if err != nil {
+			return false, fmt.Errorf("%s condition %d: %w", combinator, i, err)
+		}
+		if matched == stopAt {
+			return stopAt, nil
 		}
 	}
+	return !stopAt, nil
+}
 
-	// Now, evaluate the condition based on the comparison operator
-	for key, val := range condition {
-		switch key {
-		case "StringEquals":
-			expected, ok := val.(string)
-			inputVal, ok2 := inputValue.(string)
-			return ok && ok2 && inputVal == expected
-		case "NumericEquals":
-			expected, ok := val.(float64)
-			inputVal, ok2 := inputValue.(float64)
-			return ok && ok2 && inputVal == expected
-		case "BooleanEquals":
-			expected, ok := val.(bool)
-			inputVal, ok2 := inputValue.(bool)
-			return ok && ok2 && inputVal == expected
+// validate checks every rule of the state when the machine is built.
+func (s *ChoiceState) validate() error {
+	if err := s.dataFlow.validate(); err != nil {
+		return fmt.Errorf("choice state '%s': %w", s.name, err)
+	}
+	for i, rule := range s.choices {
+		if err := validateCondition(rule.Condition, rule.Variable); err != nil {
+			return fmt.Errorf("choice state '%s', rule %d: %w", s.name, i, err)
+		}
+	}
+	return nil
+}
+
+// conditionOperator returns the single comparison operator of a condition and its operand.
+func conditionOperator(condition Condition) (string, any, error) {
+	var operator string
+	for key := range condition {
+		if key == "InputPath" {
+			continue
+		}
+		if !isComparisonOperator(key) {
+			return "", nil, fmt.Errorf("unknown comparison operator '%s'", key)
 		}
+		if operator != "" {
+			return "", nil, fmt.Errorf("condition has more than one operator: '%s' and '%s'", operator, key)
+		}
+		operator = key
+	}
+	if operator == "" {
+		return "", nil, fmt.Errorf("condition has no comparison operator")
 	}
-	return false
+	return operator, condition[operator], nil
 }
@@ -0,0 +1,230 @@
+package statemachine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// comparisonOperators lists every operator a Choice condition can use. Each
+// of the value comparisons also has a "...Path" variant that compares against
+// another value from the input instead of a literal.
+var comparisonOperators = map[string]bool{
+	"StringEquals":               true,
+	"StringLessThan":             true,
+	"StringGreaterThan":          true,
+	"StringLessThanEquals":       true,
+	"StringGreaterThanEquals":    true,
+	"StringMatches":              true,
+	"NumericEquals":              true,
+	"NumericLessThan":            true,
+	"NumericGreaterThan":         true,
+	"NumericLessThanEquals":      true,
+	"NumericGreaterThanEquals":   true,
+	"BooleanEquals":              true,
+	"TimestampEquals":            true,
+	"TimestampLessThan":          true,
+	"TimestampGreaterThan":       true,
+	"TimestampLessThanEquals":    true,
+	"TimestampGreaterThanEquals": true,
+	"IsPresent":                  true,
+	"IsNull":                     true,
+	"IsString":                   true,
+	"IsNumeric":                  true,
+	"IsBoolean":                  true,
+	"IsTimestamp":                true,
+}
+
+// pathOperand reports whether operator is the "...Path" variant of a value
+// comparison and returns the underlying operator.
+func pathOperand(operator string) (string, bool) {
+	base, ok := strings.CutSuffix(operator, "Path")
+	if !ok || !comparisonOperators[base] || strings.HasPrefix(base, "Is") || base == "StringMatches" {
+		return operator, false
+	}
+	return base, true
+}
+
+// isComparisonOperator reports whether key names a supported operator.
+func isComparisonOperator(key string) bool {
+	if comparisonOperators[key] {
+		return true
+	}
+	_, ok := pathOperand(key)
+	return ok
+}
+
+// compare evaluates a comparison operator against a value from the input.
+// Values of the wrong type never match.
+func compare(operator string, value, operand any) (bool, error) {
+	switch operator {
+	case "IsNull", "IsString", "IsNumeric", "IsBoolean", "IsTimestamp":
+		expected, ok := operand.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s expects a boolean, got %T", operator, operand)
+		}
+		return typeTest(operator, value) == expected, nil
+	case "BooleanEquals":
+		expected, ok := operand.(bool)
+		actual, ok2 := value.(bool)
+		return ok && ok2 && actual == expected, nil
+	case "StringMatches":
+		pattern, ok := operand.(string)
+		if !ok {
+			return false, fmt.Errorf("StringMatches expects a string pattern, got %T", operand)
+		}
+		actual, ok := value.(string)
+		return ok && matchWildcard(pattern, actual), nil
+	}
+
+	var cmp int
+	switch {
+	case strings.HasPrefix(operator, "String"):
+		expected, ok := operand.(string)
+		actual, ok2 := value.(string)
+		if !ok || !ok2 {
+			return false, nil
+		}
+		cmp = strings.Compare(actual, expected)
+	case strings.HasPrefix(operator, "Numeric"):
+		expected, ok := toFloat(operand)
+		actual, ok2 := toFloat(value)
+		if !ok || !ok2 {
+			return false, nil
+		}
+		cmp = compareFloats(actual, expected)
+	case strings.HasPrefix(operator, "Timestamp"):
+		expected, ok := toTimestamp(operand)
+		actual, ok2 := toTimestamp(value)
+		if !ok || !ok2 {
+			return false, nil
+		}
+		cmp = actual.Compare(expected)
+	default:
+		return false, fmt.Errorf("unknown comparison operator '%s'", operator)
+	}
+
+	switch {
+	case strings.HasSuffix(operator, "GreaterThanEquals"):
+		return cmp >= 0, nil
+	case strings.HasSuffix(operator, "LessThanEquals"):
+		return cmp <= 0, nil
+	case strings.HasSuffix(operator, "GreaterThan"):
+		return cmp > 0, nil
+	case strings.HasSuffix(operator, "LessThan"):
+		return cmp < 0, nil
+	default:
+		return cmp == 0, nil
+	}
+}
+
+func typeTest(operator string, value any) bool {
+	switch operator {
+	case "IsNull":
+		return value == nil
+	case "IsString":
+		_, ok := value.(string)
+		return ok
+	case "IsNumeric":
+		_, ok := toFloat(value)
+		return ok
+	case "IsBoolean":
+		_, ok := value.(bool)
+		return ok
+	default:
+		_, ok := toTimestamp(value)
+		return ok
+	}
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// toFloat converts any Go numeric type to a float64.
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// toTimestamp parses an RFC 3339 string or accepts a time.Time.
+func toTimestamp(v any) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case string:
+		parsed, err := time.Parse(time.RFC3339, t)
+		return parsed, err == nil
+	default:
+		return time.Time{}, false
+	}
+}
+
+// matchWildcard reports whether s matches pattern, where "*" matches any
+// sequence of characters and "\*" matches a literal asterisk.
+func matchWildcard(pattern, s string) bool {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern) && (pattern[i+1] == '*' || pattern[i+1] == '\\'):
+			current.WriteByte(pattern[i+1])
+			i++
+		case pattern[i] == '*':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(pattern[i])
+		}
+	}
+	parts = append(parts, current.String())
+
+	if len(parts) == 1 {
+		return s == parts[0]
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
@@ -0,0 +1,236 @@
+package statemachine
+
+import (
+	"fmt"
+	"time"
+)
+
+// Condition is a Choice rule condition. A leaf condition holds an "InputPath"
+// and a single comparison operator; conditions can be combined with "And",
+// "Or" and "Not", exactly as in JSON definitions.
+type Condition map[string]any
+
+// And matches when all of the conditions match. Evaluation stops at the first
+// condition that does not match.
+func And(conditions ...Condition) Condition {
+	return Condition{"And": conditionList(conditions)}
+}
+
+// Or matches when any of the conditions matches. Evaluation stops at the
+// first condition that matches.
+func Or(conditions ...Condition) Condition {
+	return Condition{"Or": conditionList(conditions)}
+}
+
+// Not matches when the condition does not match.
+func Not(condition Condition) Condition {
+	return Condition{"Not": map[string]any(condition)}
+}
+
+func conditionList(conditions []Condition) []any {
+	list := make([]any, len(conditions))
+	for i, c := range conditions {
+		list[i] = map[string]any(c)
+	}
+	return list
+}
+
+func leaf(variable, operator string, operand any) Condition {
+	return Condition{"InputPath": variable, operator: operand}
+}
+
+// StringEquals matches when the string at variable equals value.
+func StringEquals(variable, value string) Condition {
+	return leaf(variable, "StringEquals", value)
+}
+
+// StringLessThan matches when the string at variable sorts before value.
+func StringLessThan(variable, value string) Condition {
+	return leaf(variable, "StringLessThan", value)
+}
+
+// StringGreaterThan matches when the string at variable sorts after value.
+func StringGreaterThan(variable, value string) Condition {
+	return leaf(variable, "StringGreaterThan", value)
+}
+
+// StringLessThanEquals matches when the string at variable sorts before or equals value.
+func StringLessThanEquals(variable, value string) Condition {
+	return leaf(variable, "StringLessThanEquals", value)
+}
+
+// StringGreaterThanEquals matches when the string at variable sorts after or equals value.
+func StringGreaterThanEquals(variable, value string) Condition {
+	return leaf(variable, "StringGreaterThanEquals", value)
+}
+
+// StringMatches matches the string at variable against a pattern where "*"
+// matches any sequence of characters and "\*" a literal asterisk.
+func StringMatches(variable, pattern string) Condition {
+	return leaf(variable, "StringMatches", pattern)
+}
+
+// NumericEquals matches when the number at variable equals value.
+func NumericEquals(variable string, value float64) Condition {
+	return leaf(variable, "NumericEquals", value)
+}
+
+// NumericLessThan matches when the number at variable is less than value.
+func NumericLessThan(variable string, value float64) Condition {
+	return leaf(variable, "NumericLessThan", value)
+}
+
+// NumericGreaterThan matches when the number at variable is greater than value.
+func NumericGreaterThan(variable string, value float64) Condition {
+	return leaf(variable, "NumericGreaterThan", value)
+}
+
+// NumericLessThanEquals matches when the number at variable is at most value.
+func NumericLessThanEquals(variable string, value float64) Condition {
+	return leaf(variable, "NumericLessThanEquals", value)
+}
+
+// NumericGreaterThanEquals matches when the number at variable is at least value.
+func NumericGreaterThanEquals(variable string, value float64) Condition {
+	return leaf(variable, "NumericGreaterThanEquals", value)
+}
+
+// BooleanEquals matches when the boolean at variable equals value.
+func BooleanEquals(variable string, value bool) Condition {
+	return leaf(variable, "BooleanEquals", value)
+}
+
+// TimestampEquals matches when the timestamp at variable equals value.
+func TimestampEquals(variable string, value time.Time) Condition {
+	return leaf(variable, "TimestampEquals", value.Format(time.RFC3339Nano))
+}
+
+// TimestampLessThan matches when the timestamp at variable is before value.
+func TimestampLessThan(variable string, value time.Time) Condition {
+	return leaf(variable, "TimestampLessThan", value.Format(time.RFC3339Nano))
+}
+
+// TimestampGreaterThan matches when the timestamp at variable is after value.
+func TimestampGreaterThan(variable string, value time.Time) Condition {
+	return leaf(variable, "TimestampGreaterThan", value.Format(time.RFC3339Nano))
+}
+
+// TimestampLessThanEquals matches when the timestamp at variable is not after value.
+func TimestampLessThanEquals(variable string, value time.Time) Condition {
+	return leaf(variable, "TimestampLessThanEquals", value.Format(time.RFC3339Nano))
+}
+
+// TimestampGreaterThanEquals matches when the timestamp at variable is not before value.
+func TimestampGreaterThanEquals(variable string, value time.Time) Condition {
+	return leaf(variable, "TimestampGreaterThanEquals", value.Format(time.RFC3339Nano))
+}
+
+// ComparePaths compares the values at two paths with a comparison operator
+// such as "NumericGreaterThan", using its "...Path" variant.
+func ComparePaths(variable, operator, otherVariable string) Condition {
+	return leaf(variable, operator+"Path", otherVariable)
+}
+
+// IsPresent matches when variable resolves (or does not, if present is false).
+func IsPresent(variable string, present bool) Condition {
+	return leaf(variable, "IsPresent", present)
+}
+
+// IsNull matches when the value at variable is null.
+func IsNull(variable string, is bool) Condition {
+	return leaf(variable, "IsNull", is)
+}
+
+// IsString matches when the value at variable is a string.
+func IsString(variable string, is bool) Condition {
+	return leaf(variable, "IsString", is)
+}
+
+// IsNumeric matches when the value at variable is a number.
+func IsNumeric(variable string, is bool) Condition {
+	return leaf(variable, "IsNumeric", is)
+}
+
+// IsBoolean matches when the value at variable is a boolean.
+func IsBoolean(variable string, is bool) Condition {
+	return leaf(variable, "IsBoolean", is)
+}
+
+// IsTimestamp matches when the value at variable is an RFC 3339 timestamp.
+func IsTimestamp(variable string, is bool) Condition {
+	return leaf(variable, "IsTimestamp", is)
+}
+
+// validateCondition checks that a condition is well formed and that every
+// comparison has a variable to read, either its own InputPath or the rule's.
+func validateCondition(condition Condition, variable string) error {
+	if condition == nil {
+		return fmt.Errorf("condition is empty")
+	}
+	for _, combinator := range []string{"And", "Or", "Not"} {
+		operand, ok := condition[combinator]
+		if !ok {
+			continue
+		}
+		if len(condition) != 1 {
+			return fmt.Errorf("'%s' cannot be combined with other fields in the same condition", combinator)
+		}
+		if combinator == "Not" {
+			nested, ok := asCondition(operand)
+			if !ok {
+				return fmt.Errorf("Not expects a condition, got %T", operand)
+			}
+			return validateCondition(nested, variable)
+		}
+		list, ok := operand.([]any)
+		if !ok || len(list) == 0 {
+			return fmt.Errorf("%s expects a non-empty list of conditions", combinator)
+		}
+		for i, item := range list {
+			nested, ok := asCondition(item)
+			if !ok {
+				return fmt.Errorf("%s condition %d is %T, not a condition", combinator, i, item)
+			}
+			if err := validateCondition(nested, variable); err != nil {
+				return fmt.Errorf("%s condition %d: %w", combinator, i, err)
+			}
+		}
+		return nil
+	}
+
+	operator, operand, err := conditionOperator(condition)
+	if err != nil {
+		return err
+	}
+	path, _ := condition["InputPath"].(string)
+	if path == "" {
+		path = variable
+	}
+	if path == "" {
+		return fmt.Errorf("condition does not reference a variable: set InputPath on the condition or Variable on the rule")
+	}
+	if _, err := compilePath(path); err != nil {
+		return err
+	}
+	if _, ok := pathOperand(operator); ok {
+		operandPath, ok := operand.(string)
+		if !ok {
+			return fmt.Errorf("%s expects a path, got %T", operator, operand)
+		}
+		if _, err := compilePath(operandPath); err != nil {
+			return fmt.Errorf("%s: %w", operator, err)
+		}
+	}
+	return nil
+}
+
+func asCondition(v any) (Condition, bool) {
+	switch c := v.(type) {
+	case map[string]any:
+		return c, true
+	case Condition:
+		return c, true
+	default:
+		return nil, false
+	}
+}
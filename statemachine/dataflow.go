@@ -0,0 +1,129 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+)
+
+// DataFlow controls how a state filters its input and where its result is
+// placed, following the Step Functions input and output processing model:
+//
+//	InputPath -> Parameters -> state work -> ResultSelector -> ResultPath -> OutputPath
+//
+// Empty paths default to "$". Choice and Wait states only use InputPath and
+// OutputPath, and Map states use Parameters as their ItemSelector.
+type DataFlow struct {
+	InputPath      string         `json:"InputPath,omitempty"`
+	Parameters     map[string]any `json:"Parameters,omitempty"`
+	ResultSelector map[string]any `json:"ResultSelector,omitempty"`
+	ResultPath     string         `json:"ResultPath,omitempty"`
+	OutputPath     string         `json:"OutputPath,omitempty"`
+}
+
+// filterInput applies InputPath to the raw state input.
+func (f DataFlow) filterInput(ctx context.Context, raw map[string]any) (any, error) {
+	input, err := getPath(ctx, raw, f.InputPath)
+	if err != nil {
+		return nil, fmt.Errorf("InputPath: %w", err)
+	}
+	return input, nil
+}
+
+// effectiveInput applies InputPath and then Parameters to the raw state input.
+func (f DataFlow) effectiveInput(ctx context.Context, raw map[string]any) (any, error) {
+	input, err := f.filterInput(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if f.Parameters == nil {
+		return input, nil
+	}
+	params, err := applyTemplate(ctx, f.Parameters, input)
+	if err != nil {
+		return nil, fmt.Errorf("Parameters: %w", err)
+	}
+	return params, nil
+}
+
+// inPlace reports whether the state works directly on its raw input. This is
+// the case for the default data flow, where tasks mutate the data they are
+// given and that data becomes the state output.
+func (f DataFlow) inPlace() bool {
+	return isRootPath(f.InputPath) && f.Parameters == nil && isRootPath(f.ResultPath)
+}
+
+// workingContext returns the context a task or Pass modifier operates on.
+func (f DataFlow) workingContext(sc *StateContext, input any) (*StateContext, error) {
+	if f.inPlace() {
+		return sc, nil
+	}
+	data, ok := input.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("effective input must be a JSON object, got %T", input)
+	}
+	return &StateContext{Data: copyData(data)}, nil
+}
+
+// stateOutput applies ResultSelector, ResultPath and OutputPath to a state's
+// result, merging it into the raw state input.
+func (f DataFlow) stateOutput(ctx context.Context, raw map[string]any, result any) (map[string]any, error) {
+	if f.ResultSelector != nil {
+		selected, err := applyTemplate(ctx, f.ResultSelector, result)
+		if err != nil {
+			return nil, fmt.Errorf("ResultSelector: %w", err)
+		}
+		result = selected
+	}
+
+	combined := result
+	if !isRootPath(f.ResultPath) {
+		var err error
+		if combined, err = setPath(raw, f.ResultPath, copyValue(result)); err != nil {
+			return nil, fmt.Errorf("ResultPath: %w", err)
+		}
+	}
+	return f.filterOutput(ctx, combined)
+}
+
+// validate compiles the paths and templates of the data flow, so that a
+// malformed one is reported when the state machine is built.
+func (f DataFlow) validate() error {
+	if _, err := compilePath(f.InputPath); err != nil {
+		return fmt.Errorf("InputPath: %w", err)
+	}
+	if err := validateTemplate(f.Parameters); err != nil {
+		return fmt.Errorf("Parameters: %w", err)
+	}
+	if err := validateTemplate(f.ResultSelector); err != nil {
+		return fmt.Errorf("ResultSelector: %w", err)
+	}
+	if _, err := compileReferencePath(f.ResultPath); err != nil {
+		return fmt.Errorf("ResultPath: %w", err)
+	}
+	if _, err := compilePath(f.OutputPath); err != nil {
+		return fmt.Errorf("OutputPath: %w", err)
+	}
+	return nil
+}
+
+// validatePathsOnly checks that the data flow of a Choice or Wait state sets
+// nothing those states would ignore.
+func (f DataFlow) validatePathsOnly(state State) error {
+	if f.Parameters != nil || f.ResultSelector != nil || f.ResultPath != "" {
+		return fmt.Errorf("only InputPath and OutputPath apply to %s states", stateType(state))
+	}
+	return nil
+}
+
+// filterOutput applies OutputPath to the combined state output.
+func (f DataFlow) filterOutput(ctx context.Context, combined any) (map[string]any, error) {
+	output, err := getPath(ctx, combined, f.OutputPath)
+	if err != nil {
+		return nil, fmt.Errorf("OutputPath: %w", err)
+	}
+	data, ok := output.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("state output must be a JSON object, got %T", output)
+	}
+	return data, nil
+}
@@ -1,6 +1,13 @@
 package statemachine
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"sync"
+)
 
 // CustomError is a type that can be checked by the state machine's error handling.
 type CustomError struct {
@@ -22,3 +29,204 @@ var (
 	ErrAPIBadGateway = &CustomError{Name: "API_BAD_GATEWAY", Err: fmt.Errorf("api service is unavailable")}
 	ErrTimeout       = &CustomError{Name: "TIMEOUT", Err: fmt.Errorf("task timed out")}
 )
+
+// Reserved error names that Retry and Catch rules can match on.
+const (
+	// ErrorAll matches every error. It must be the only name of its rule and
+	// that rule must come last.
+	ErrorAll = "States.ALL"
+	// ErrorTimeout matches tasks that ran longer than their timeout.
+	ErrorTimeout = "States.Timeout"
+	// ErrorTaskFailed matches every error except a timeout.
+	ErrorTaskFailed = "States.TaskFailed"
+	// ErrorPermissions matches ErrPermissions and any CustomError named States.Permissions.
+	ErrorPermissions = "States.Permissions"
+	// ErrorHeartbeatTimeout matches tasks that did not send a heartbeat
+	// within their HeartbeatSeconds. States.Timeout matches them too.
+	ErrorHeartbeatTimeout = "States.HeartbeatTimeout"
+	// ErrorCanceled matches context.Canceled, returned when the execution
+	// context is cancelled.
+	ErrorCanceled = "States.Canceled"
+	// ErrorRuntime matches panics recovered from task functions.
+	ErrorRuntime = "States.Runtime"
+	// ErrorExceedToleratedFailureThreshold matches Map states in which more
+	// iterations failed than their tolerated failure count or percentage.
+	ErrorExceedToleratedFailureThreshold = "States.ExceedToleratedFailureThreshold"
+)
+
+// ErrHeartbeatTimeout is the error of a task attempt that missed a heartbeat.
+var ErrHeartbeatTimeout = &CustomError{Name: ErrorHeartbeatTimeout, Err: fmt.Errorf("task did not send a heartbeat in time")}
+
+// ErrExecutionTimeout is the error of an execution that ran longer than the
+// timeout of its state machine.
+var ErrExecutionTimeout = &CustomError{Name: ErrorTimeout, Err: fmt.Errorf("execution timed out")}
+
+// ErrToleratedFailureThreshold is the error of a Map state in which more
+// iterations failed than it tolerates.
+var ErrToleratedFailureThreshold = &CustomError{Name: ErrorExceedToleratedFailureThreshold, Err: fmt.Errorf("too many map iterations failed")}
+
+// errSiblingFailed is the cause a Map or Parallel state cancels its
+// remaining iterations or branches with once one of them failed the state.
+var errSiblingFailed = errors.New("a sibling iteration or branch failed")
+
+// ErrPermissions can be returned by tasks that were denied access to a resource.
+var ErrPermissions = &CustomError{Name: ErrorPermissions, Err: fmt.Errorf("insufficient privileges")}
+
+// PanicError is the error a task fails with when its function panics.
+type PanicError struct {
+	Value any
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func newPanicError(value any) *PanicError {
+	return &PanicError{Value: value, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverPanic turns a panic into a PanicError stored in *err. It must be
+// deferred directly.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = newPanicError(r)
+	}
+}
+
+type registeredError struct {
+	name    string
+	matches func(error) bool
+}
+
+var errorRegistry struct {
+	sync.RWMutex
+	errors []registeredError
+}
+
+// RegisterError gives a sentinel error a name that Retry and Catch rules,
+// including those of JSON definitions, can match. An error matches if
+// errors.Is(err, target) holds.
+func RegisterError(name string, target error) {
+	registerError(name, func(err error) bool {
+		return errors.Is(err, target)
+	})
+}
+
+// RegisterErrorType gives the error type T a name that Retry and Catch
+// rules, including those of JSON definitions, can match. An error matches if
+// errors.As finds a T in its chain.
+func RegisterErrorType[T error](name string) {
+	registerError(name, func(err error) bool {
+		var target T
+		return errors.As(err, &target)
+	})
+}
+
+func registerError(name string, matches func(error) bool) {
+	errorRegistry.Lock()
+	defer errorRegistry.Unlock()
+	errorRegistry.errors = append(errorRegistry.errors, registeredError{name: name, matches: matches})
+}
+
+// errorNames returns every name err is known by, most specific first:
+// the names of CustomErrors in its chain, registered names and the reserved
+// names of timeouts, cancellation and panics.
+func errorNames(err error) []string {
+	var names []string
+	var customErr *CustomError
+	for chain := err; errors.As(chain, &customErr); chain = customErr.Err {
+		names = append(names, customErr.Name)
+	}
+
+	errorRegistry.RLock()
+	for _, registered := range errorRegistry.errors {
+		if registered.matches(err) {
+			names = append(names, registered.name)
+		}
+	}
+	errorRegistry.RUnlock()
+
+	var panicErr *PanicError
+	switch {
+	case errors.Is(err, ErrTimeout) || errors.Is(err, ErrHeartbeatTimeout) || errors.Is(err, context.DeadlineExceeded):
+		names = append(names, ErrorTimeout)
+	case errors.Is(err, context.Canceled):
+		names = append(names, ErrorCanceled)
+	case errors.As(err, &panicErr):
+		names = append(names, ErrorRuntime)
+	}
+	return names
+}
+
+// errorName returns the stable name of err, as reported in events.
+func errorName(err error) string {
+	if names := errorNames(err); len(names) > 0 {
+		return names[0]
+	}
+	return ErrorTaskFailed
+}
+
+// errorOutput returns the error output that Catch rules write at their
+// ResultPath.
+func errorOutput(err error) map[string]any {
+	return map[string]any{"Error": errorName(err), "Cause": err.Error()}
+}
+
+// errorMatcher is the part of a Retry or Catch rule that selects errors.
+type errorMatcher struct {
+	names   []string
+	errors  []error
+	matchFn func(error) bool
+}
+
+// match returns the name err was matched by, and whether it matched.
+// Errors matched through errors.Is or a predicate are reported by their
+// stable name.
+func (m errorMatcher) match(err error) (string, bool) {
+	for _, name := range m.names {
+		if errorMatches(name, err) {
+			return name, true
+		}
+	}
+	for _, target := range m.errors {
+		if errors.Is(err, target) {
+			return errorName(err), true
+		}
+	}
+	if m.matchFn != nil && m.matchFn(err) {
+		return errorName(err), true
+	}
+	return "", false
+}
+
+// errorMatches reports whether the error name matches err.
+func errorMatches(name string, err error) bool {
+	switch name {
+	case ErrorAll:
+		return true
+	case ErrorTaskFailed:
+		return !slices.Contains(errorNames(err), ErrorTimeout)
+	}
+	return slices.Contains(errorNames(err), name)
+}
+
+// validate checks the matcher of the retry or catch rule at index i of count rules.
+func (m errorMatcher) validate(i, count int) error {
+	if len(m.names) == 0 && len(m.errors) == 0 && m.matchFn == nil {
+		return fmt.Errorf("rule %d matches no errors", i)
+	}
+	for _, name := range m.names {
+		if name == ErrorAll && (len(m.names) > 1 || i != count-1) {
+			return fmt.Errorf("rule %d: %s must be the only error name of the last rule", i, ErrorAll)
+		}
+	}
+	return nil
+}
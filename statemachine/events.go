@@ -0,0 +1,138 @@
+package statemachine
+
+import (
+	"context"
+	"time"
+)
+
+// EventType identifies an execution lifecycle event.
+type EventType string
+
+const (
+	EventExecutionStarted        EventType = "ExecutionStarted"
+	EventExecutionSucceeded      EventType = "ExecutionSucceeded"
+	EventExecutionFailed         EventType = "ExecutionFailed"
+	EventExecutionAborted        EventType = "ExecutionAborted"
+	EventExecutionTimedOut       EventType = "ExecutionTimedOut"
+	EventExecutionResumed        EventType = "ExecutionResumed"
+	EventStateEntered            EventType = "StateEntered"
+	EventStateExited             EventType = "StateExited"
+	EventTaskAttemptStarted      EventType = "TaskAttemptStarted"
+	EventTaskAttemptSucceeded    EventType = "TaskAttemptSucceeded"
+	EventTaskAttemptFailed       EventType = "TaskAttemptFailed"
+	EventTaskAttemptAbandoned    EventType = "TaskAttemptAbandoned"
+	EventRetryScheduled          EventType = "RetryScheduled"
+	EventErrorCaught             EventType = "ErrorCaught"
+	EventMapIterationStarted     EventType = "MapIterationStarted"
+	EventMapIterationSucceeded   EventType = "MapIterationSucceeded"
+	EventMapIterationFailed      EventType = "MapIterationFailed"
+	EventParallelBranchStarted   EventType = "ParallelBranchStarted"
+	EventParallelBranchSucceeded EventType = "ParallelBranchSucceeded"
+	EventParallelBranchFailed    EventType = "ParallelBranchFailed"
+)
+
+// Event describes something that happened during an execution. Fields that
+// do not apply to an event type are left at their zero value.
+type Event struct {
+	Type              EventType
+	Timestamp         time.Time
+	ExecutionID       string
+	ParentExecutionID string
+
+	// StateName and StateType identify the state the event belongs to. They
+	// are empty for ExecutionStarted and ExecutionSucceeded.
+	StateName string
+	StateType string
+
+	// Input is a snapshot of the data a state or execution started with,
+	// Output of the data it finished with.
+	Input  map[string]any
+	Output map[string]any
+
+	// NextState is the state an execution moves to after StateExited and ErrorCaught.
+	NextState string
+
+	// Attempt is the 1-based task attempt for the TaskAttempt events, the
+	// attempt about to be made for RetryScheduled, and the attempts already
+	// made in the state an execution continues from for ExecutionResumed.
+	Attempt int
+	// Duration is how long the state, task attempt, Map iteration, Parallel
+	// branch or execution took, for events that mark the end of one.
+	Duration time.Duration
+	// RetryDelay is how long the task waits before the scheduled retry.
+	RetryDelay time.Duration
+	// ErrorName is the stable name of the error in TaskAttemptFailed, and the
+	// name it was matched by in ErrorCaught.
+	ErrorName string
+	Error     error
+
+	// Index and ChildExecutionID identify a Map iteration or Parallel branch.
+	Index            int
+	ChildExecutionID string
+	// InFlight and Queued are the number of iterations of the Map state that
+	// are running and that are waiting for a worker, counted right after the
+	// MapIteration event.
+	InFlight int
+	Queued   int
+
+	// child is the finished nested execution, whose history is attached to
+	// the event when it is recorded.
+	child *Execution
+}
+
+// Listener receives execution lifecycle events. OnEvent is called
+// synchronously from the goroutine that produced the event, which for Map
+// iterations and Parallel branches means concurrently, so implementations
+// must be safe for concurrent use and should return quickly.
+type Listener interface {
+	OnEvent(event Event)
+}
+
+// ListenerFunc adapts an ordinary function to the Listener interface.
+type ListenerFunc func(event Event)
+
+func (f ListenerFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// WithListener adds a listener to the execution. Nested executions started by
+// Map and Parallel states report to the same listeners.
+func WithListener(listener Listener) ExecutionOption {
+	return func(e *Execution) {
+		e.listeners = append(e.listeners, listener)
+	}
+}
+
+// emit fills in the execution fields of an event, records it in the history
+// and passes it to every listener.
+func (e *Execution) emit(event Event) {
+	if e.noHistory && len(e.listeners) == 0 {
+		return
+	}
+	event.Timestamp = time.Now()
+	event.ExecutionID = e.ID
+	if e.parent != nil {
+		event.ParentExecutionID = e.parent.ID
+	}
+	if event.Input != nil {
+		event.Input = copyData(event.Input)
+	}
+	if event.Output != nil {
+		event.Output = copyData(event.Output)
+	}
+	e.record(event)
+	for _, listener := range e.listeners {
+		listener.OnEvent(event)
+	}
+}
+
+// emitStateEvent emits an event for the state running in ctx.
+func emitStateEvent(ctx context.Context, state State, event Event) {
+	e := ExecutionFromContext(ctx)
+	if e == nil {
+		return
+	}
+	event.StateName = state.GetName()
+	event.StateType = stateType(state)
+	e.emit(event)
+}
@@ -0,0 +1,471 @@
+package statemachine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExecutionStatus describes where an execution is in its lifecycle.
+type ExecutionStatus string
+
+const (
+	ExecutionRunning   ExecutionStatus = "RUNNING"
+	ExecutionSucceeded ExecutionStatus = "SUCCEEDED"
+	ExecutionFailed    ExecutionStatus = "FAILED"
+	ExecutionAborted   ExecutionStatus = "ABORTED"
+	ExecutionTimedOut  ExecutionStatus = "TIMED_OUT"
+)
+
+// ExecutionOption customises a single execution started with Start or Run.
+type ExecutionOption func(*Execution)
+
+// WithExecutionID sets the ID of the execution instead of generating a random one.
+func WithExecutionID(id string) ExecutionOption {
+	return func(e *Execution) {
+		e.ID = id
+	}
+}
+
+// Execution is a single run of a StateMachine. All per-run state lives here,
+// so one StateMachine can be shared by any number of concurrent executions.
+type Execution struct {
+	ID        string
+	Input     map[string]any
+	StartTime time.Time
+
+	machine   *StateMachine
+	context   *StateContext
+	done      chan struct{}
+	parent    *Execution
+	logger    *slog.Logger
+	listeners []Listener
+	store     Store
+	// resume is the checkpoint a resumed execution continues from.
+	resume *Checkpoint
+
+	historyMu sync.Mutex
+	history   []HistoryEvent
+	// noHistory stops events from being recorded in history.
+	noHistory bool
+
+	// abandoned counts task attempts that timed out but whose function has
+	// not returned yet.
+	abandoned atomic.Int64
+
+	mu           sync.RWMutex
+	status       ExecutionStatus
+	currentState string
+	stateEntered time.Time
+	output       map[string]any
+	err          error
+	stopTime     time.Time
+	// attempts is the number of task attempts the current state had already
+	// made before the execution was resumed.
+	attempts int
+}
+
+type executionKey struct{}
+
+// ExecutionFromContext returns the execution running the current state, if any.
+func ExecutionFromContext(ctx context.Context) *Execution {
+	e, _ := ctx.Value(executionKey{}).(*Execution)
+	return e
+}
+
+// Status returns the current status of the execution.
+func (e *Execution) Status() ExecutionStatus {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.status
+}
+
+// CurrentState returns the name of the state being executed, or the last
+// state that ran once the execution has stopped.
+func (e *Execution) CurrentState() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.currentState
+}
+
+// Output returns the data of the execution once it has stopped. For failed
+// executions it holds the data as it was when the failure happened.
+func (e *Execution) Output() map[string]any {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.output
+}
+
+// Err returns the error that stopped the execution, if any.
+func (e *Execution) Err() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.err
+}
+
+// StopTime returns when the execution stopped, or the zero time while it is running.
+func (e *Execution) StopTime() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.stopTime
+}
+
+// AbandonedTasks returns the number of task attempts of the execution that
+// timed out or were cancelled but whose function is still running. Their
+// writes are discarded; a non-zero count after the execution stopped points
+// to a task function that ignores its context.
+func (e *Execution) AbandonedTasks() int {
+	return int(e.abandoned.Load())
+}
+
+// Done returns a channel that is closed once the execution has stopped.
+func (e *Execution) Done() <-chan struct{} {
+	return e.done
+}
+
+// Wait blocks until the execution stops and returns its error.
+func (e *Execution) Wait() error {
+	<-e.done
+	return e.Err()
+}
+
+func (e *Execution) run(ctx context.Context) {
+	defer close(e.done)
+	ctx = context.WithValue(ctx, executionKey{}, e)
+	if timeout := e.machine.timeout; timeout > 0 {
+		// The deadline counts from the original start, also after a resume.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadlineCause(ctx, e.StartTime.Add(timeout), ErrExecutionTimeout)
+		defer cancel()
+	}
+
+	logger := e.logger.With("execution_id", e.ID)
+	if e.parent != nil {
+		logger = logger.With("parent_execution_id", e.parent.ID)
+	}
+	logger.Info("execution started")
+	startAt := e.machine.startAt
+	if e.resume != nil {
+		startAt = e.resume.StateName
+		logger.Info("execution resumed", "state", startAt, "attempts", e.resume.Attempts)
+		e.emit(Event{Type: EventExecutionResumed, StateName: startAt, Input: e.context.Data, Attempt: e.resume.Attempts})
+	} else {
+		e.emit(Event{Type: EventExecutionStarted, Input: e.context.Data})
+	}
+
+	state := e.machine.GetState(startAt)
+	if state == nil {
+		e.stop(ctx, logger, nil, ExecutionFailed, fmt.Errorf("start state '%s' not found", startAt))
+		return
+	}
+
+	for state != nil {
+		if err := ctx.Err(); err != nil {
+			if timedOut(ctx) {
+				e.stop(ctx, logger, state, ExecutionTimedOut, fmt.Errorf("execution timed out before state '%s': %w", state.GetName(), ErrExecutionTimeout))
+				return
+			}
+			e.stop(ctx, logger, state, ExecutionAborted, fmt.Errorf("execution aborted before state '%s': %w", state.GetName(), err))
+			return
+		}
+		entered, attempts := time.Now(), 0
+		if e.resume != nil {
+			entered, attempts = e.resume.StateEnteredTime, e.resume.Attempts
+			e.resume = nil
+		}
+		e.setCurrentState(state.GetName(), entered, attempts)
+		if err := e.saveCheckpoint(ctx, ExecutionRunning, state.GetName(), attempts, nil); err != nil {
+			e.stop(ctx, logger, state, ExecutionFailed, err)
+			return
+		}
+
+		stateLogger := logger.With("state", state.GetName(), "state_type", stateType(state))
+		stateLogger.Debug("entering state")
+		e.emit(Event{Type: EventStateEntered, StateName: state.GetName(), StateType: stateType(state), Input: e.context.Data})
+
+		nextState, err := e.executeState(withLogger(ctx, stateLogger), state)
+		if err != nil {
+			if timedOut(ctx) {
+				e.stop(ctx, logger, state, ExecutionTimedOut, fmt.Errorf("execution timed out in state '%s': %w", state.GetName(), ErrExecutionTimeout))
+				return
+			}
+			if ctx.Err() != nil {
+				e.stop(ctx, logger, state, ExecutionAborted, fmt.Errorf("execution aborted in state '%s': %w", state.GetName(), err))
+				return
+			}
+			e.stop(ctx, logger, state, ExecutionFailed, fmt.Errorf("state '%s' failed: %w", state.GetName(), err))
+			return
+		}
+
+		exited := Event{Type: EventStateExited, StateName: state.GetName(), StateType: stateType(state), Output: e.context.Data, Duration: time.Since(entered)}
+		if nextState != nil {
+			exited.NextState = nextState.GetName()
+		}
+		e.emit(exited)
+
+		state = nextState
+	}
+	e.stop(ctx, logger, nil, ExecutionSucceeded, nil)
+}
+
+// timedOut reports whether ctx was cancelled because the execution ran past
+// the timeout of its state machine.
+func timedOut(ctx context.Context) bool {
+	return ctx.Err() != nil && errors.Is(context.Cause(ctx), ErrExecutionTimeout)
+}
+
+// executeState runs state, turning a panic into a PanicError so that it
+// fails the execution instead of crashing the process.
+func (e *Execution) executeState(ctx context.Context, state State) (next State, err error) {
+	defer recoverPanic(&err)
+	return state.Execute(ctx, e.context, e.machine)
+}
+
+func (e *Execution) setCurrentState(name string, entered time.Time, attempts int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.currentState = name
+	e.stateEntered = entered
+	e.attempts = attempts
+}
+
+// stateEnteredTime returns when the current state was entered. For a resumed
+// execution that is the time recorded before the execution stopped.
+func (e *Execution) stateEnteredTime() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.stateEntered
+}
+
+// resumedAttempts returns the number of task attempts the current state had
+// already made before the execution was resumed.
+func (e *Execution) resumedAttempts() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.attempts
+}
+
+// contextObject returns the context object that "$$" paths are evaluated against.
+func (e *Execution) contextObject() map[string]any {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return map[string]any{
+		"Execution": map[string]any{
+			"Id":        e.ID,
+			"Input":     e.Input,
+			"StartTime": e.StartTime.Format(time.RFC3339Nano),
+		},
+		"State": map[string]any{
+			"Name":        e.currentState,
+			"EnteredTime": e.stateEntered.Format(time.RFC3339Nano),
+		},
+	}
+}
+
+// contextObjectFrom returns the context object of the execution running in
+// ctx, or an empty object outside of an execution. While a Map state builds
+// the input of an iteration it also holds the item under "Map".
+func contextObjectFrom(ctx context.Context) map[string]any {
+	object := map[string]any{}
+	if e := ExecutionFromContext(ctx); e != nil {
+		object = e.contextObject()
+	}
+	if item, ok := ctx.Value(mapItemKey{}).(mapItem); ok {
+		object["Map"] = map[string]any{
+			"Item": map[string]any{"Index": item.index, "Value": item.value},
+		}
+	}
+	return object
+}
+
+// stop records the final status of the execution. state is the state that
+// was running when the execution failed or was aborted.
+func (e *Execution) stop(ctx context.Context, logger *slog.Logger, state State, status ExecutionStatus, err error) {
+	if status != ExecutionAborted {
+		stateName := ""
+		if state != nil {
+			stateName = state.GetName()
+		}
+		// An aborted execution keeps its last running checkpoint, so it can be resumed.
+		if saveErr := e.saveCheckpoint(context.WithoutCancel(ctx), status, stateName, 0, err); saveErr != nil {
+			logger.Error("could not save final checkpoint", "error", saveErr)
+		}
+	}
+
+	e.mu.Lock()
+	e.status = status
+	e.err = err
+	e.output = e.context.Data
+	e.stopTime = time.Now()
+	e.mu.Unlock()
+
+	if err != nil {
+		logger.Error("execution stopped", "status", status, "error", err)
+	} else {
+		logger.Info("execution stopped", "status", status)
+	}
+	if abandoned := e.AbandonedTasks(); abandoned > 0 {
+		logger.Warn("abandoned task attempts still running", "count", abandoned)
+	}
+
+	event := Event{Type: EventExecutionSucceeded, Output: e.output, Error: err, Duration: e.stopTime.Sub(e.StartTime)}
+	switch status {
+	case ExecutionFailed:
+		event.Type = EventExecutionFailed
+	case ExecutionAborted:
+		event.Type = EventExecutionAborted
+	case ExecutionTimedOut:
+		event.Type = EventExecutionTimedOut
+	}
+	if state != nil {
+		event.StateName = state.GetName()
+		event.StateType = stateType(state)
+	}
+	e.emit(event)
+}
+
+// childOptions returns the options for a nested execution started by a Map
+// or Parallel state, so that it inherits the configuration of its parent.
+func childOptions(ctx context.Context, name string) []ExecutionOption {
+	parent := ExecutionFromContext(ctx)
+	if parent == nil {
+		return nil
+	}
+	return []ExecutionOption{
+		WithExecutionID(childExecutionID(ctx, name)),
+		WithLogger(parent.logger),
+		func(e *Execution) {
+			e.parent = parent
+			e.listeners = parent.listeners
+			e.noHistory = parent.noHistory
+		},
+	}
+}
+
+func newExecutionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("exec-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Cloner is implemented by values stored in StateContext.Data that know how
+// to copy themselves. Clone must return a value of the same type.
+type Cloner interface {
+	Clone() any
+}
+
+var clonerType = reflect.TypeFor[Cloner]()
+
+// copyValue returns a deep copy of a value stored in the state data. JSON-like
+// data is copied directly; other Go values, like typed slices, maps, pointers
+// and structs, are copied by reflection unless they implement Cloner. Fields
+// that reflection cannot set, such as unexported fields of structs, as well as
+// channels and functions, are shared with the original.
+func copyValue(v any) any {
+	switch v := v.(type) {
+	case nil, string, bool, float64, int, int64:
+		return v
+	case map[string]any:
+		return copyData(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = copyValue(item)
+		}
+		return out
+	case Cloner:
+		return v.Clone()
+	default:
+		return copyReflect(reflect.ValueOf(v), map[uintptr]reflect.Value{}).Interface()
+	}
+}
+
+// copyReflect returns a deep copy of v. seen maps the pointers already copied
+// to their copies, so that cyclic values are copied once.
+func copyReflect(v reflect.Value, seen map[uintptr]reflect.Value) reflect.Value {
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return v
+	}
+	if v.CanInterface() && v.Type().Implements(clonerType) {
+		if cloned := reflect.ValueOf(v.Interface().(Cloner).Clone()); cloned.IsValid() && cloned.Type().AssignableTo(v.Type()) {
+			return cloned
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(copyReflect(v.Elem(), seen))
+		return out
+	case reflect.Pointer:
+		if out, ok := seen[v.Pointer()]; ok {
+			return out
+		}
+		out := reflect.New(v.Type().Elem())
+		seen[v.Pointer()] = out
+		out.Elem().Set(copyReflect(v.Elem(), seen))
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			out.Index(i).Set(copyReflect(v.Index(i), seen))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := range v.Len() {
+			out.Index(i).Set(copyReflect(v.Index(i), seen))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			out.SetMapIndex(iter.Key(), copyReflect(iter.Value(), seen))
+		}
+		return out
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := range v.NumField() {
+			if field := out.Field(i); field.CanSet() {
+				field.Set(copyReflect(v.Field(i), seen))
+			}
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// copyData returns a deep copy of a state's data map.
+func copyData(data map[string]any) map[string]any {
+	out := make(map[string]any, len(data))
+	for k, v := range data {
+		out[k] = copyValue(v)
+	}
+	return out
+}
+
+// childExecutionID returns the ID of the nested execution called name that is
+// started from the execution running in ctx.
+func childExecutionID(ctx context.Context, name string) string {
+	if parent := ExecutionFromContext(ctx); parent != nil {
+		return parent.ID + "/" + name
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package statemachine
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// History is the ordered record of the events of one execution, similar to
+// the Step Functions execution history.
+type History struct {
+	ExecutionID string         `json:"ExecutionId"`
+	Events      []HistoryEvent `json:"Events"`
+}
+
+// HistoryEvent is an Event together with its position in the history.
+type HistoryEvent struct {
+	// ID is the 1-based position of the event in its history.
+	ID int
+	Event
+	// Nested is the history of the Map iteration or Parallel branch that
+	// finished with this event.
+	Nested *History
+}
+
+// WithHistory turns the execution history on or off; it is on by default.
+// The history keeps a copy of the data before and after every state, and the
+// full history of every Map iteration and Parallel branch, so it grows with
+// the number of items processed. Without it, History returns no events, Map
+// and Parallel states do not keep the histories of their nested executions
+// and listeners still receive every event.
+func WithHistory(enabled bool) ExecutionOption {
+	return func(e *Execution) {
+		e.noHistory = !enabled
+	}
+}
+
+// History returns a snapshot of the events recorded so far. It can be called
+// while the execution is still running.
+func (e *Execution) History() *History {
+	e.historyMu.Lock()
+	defer e.historyMu.Unlock()
+	return &History{ExecutionID: e.ID, Events: slices.Clone(e.history)}
+}
+
+func (e *Execution) record(event Event) {
+	if e.noHistory {
+		return
+	}
+	entry := HistoryEvent{Event: event}
+	if event.child != nil {
+		entry.Nested = event.child.History()
+		entry.child = nil
+	}
+
+	e.historyMu.Lock()
+	defer e.historyMu.Unlock()
+	entry.ID = len(e.history) + 1
+	e.history = append(e.history, entry)
+}
+
+// Filter returns the events of the given types, in order.
+func (h *History) Filter(types ...EventType) []HistoryEvent {
+	var events []HistoryEvent
+	for _, event := range h.Events {
+		if slices.Contains(types, event.Type) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// State returns the events that belong to the named state, in order.
+func (h *History) State(name string) []HistoryEvent {
+	var events []HistoryEvent
+	for _, event := range h.Events {
+		if event.StateName == name {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Failures returns every TaskAttemptFailed, MapIterationFailed,
+// ParallelBranchFailed, ExecutionFailed and ExecutionTimedOut event,
+// including those of nested executions, in the order they were recorded.
+func (h *History) Failures() []HistoryEvent {
+	var events []HistoryEvent
+	for _, event := range h.Events {
+		if event.Nested != nil {
+			events = append(events, event.Nested.Failures()...)
+		}
+		switch event.Type {
+		case EventTaskAttemptFailed, EventMapIterationFailed, EventParallelBranchFailed, EventExecutionFailed, EventExecutionTimedOut:
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// historyEventJSON is the JSON form of a HistoryEvent. Errors are exported as
+// their message and durations in milliseconds.
+type historyEventJSON struct {
+	ID                int            `json:"Id"`
+	Type              EventType      `json:"Type"`
+	Timestamp         time.Time      `json:"Timestamp"`
+	ExecutionID       string         `json:"ExecutionId"`
+	ParentExecutionID string         `json:"ParentExecutionId,omitempty"`
+	StateName         string         `json:"StateName,omitempty"`
+	StateType         string         `json:"StateType,omitempty"`
+	Input             map[string]any `json:"Input,omitempty"`
+	Output            map[string]any `json:"Output,omitempty"`
+	NextState         string         `json:"NextState,omitempty"`
+	Attempt           int            `json:"Attempt,omitempty"`
+	DurationMillis    float64        `json:"DurationMillis,omitempty"`
+	RetryDelayMillis  float64        `json:"RetryDelayMillis,omitempty"`
+	ErrorName         string         `json:"ErrorName,omitempty"`
+	Error             string         `json:"Error,omitempty"`
+	Index             *int           `json:"Index,omitempty"`
+	ChildExecutionID  string         `json:"ChildExecutionId,omitempty"`
+	InFlight          *int           `json:"InFlight,omitempty"`
+	Queued            *int           `json:"Queued,omitempty"`
+	Nested            *History       `json:"Nested,omitempty"`
+}
+
+func (h HistoryEvent) MarshalJSON() ([]byte, error) {
+	out := historyEventJSON{
+		ID:                h.ID,
+		Type:              h.Type,
+		Timestamp:         h.Timestamp,
+		ExecutionID:       h.ExecutionID,
+		ParentExecutionID: h.ParentExecutionID,
+		StateName:         h.StateName,
+		StateType:         h.StateType,
+		Input:             h.Input,
+		Output:            h.Output,
+		NextState:         h.NextState,
+		Attempt:           h.Attempt,
+		DurationMillis:    float64(h.Duration) / float64(time.Millisecond),
+		RetryDelayMillis:  float64(h.RetryDelay) / float64(time.Millisecond),
+		ErrorName:         h.ErrorName,
+		ChildExecutionID:  h.ChildExecutionID,
+		Nested:            h.Nested,
+	}
+	if h.Error != nil {
+		out.Error = h.Error.Error()
+	}
+	if h.ChildExecutionID != "" {
+		out.Index = &h.Index
+	}
+	switch h.Type {
+	case EventMapIterationStarted, EventMapIterationSucceeded, EventMapIterationFailed:
+		out.InFlight, out.Queued = &h.InFlight, &h.Queued
+	}
+	return json.Marshal(out)
+}
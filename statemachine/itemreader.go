@@ -0,0 +1,222 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ItemInputType is the format of the file an ItemReader reads.
+type ItemInputType string
+
+const (
+	// InputTypeJSON is a file holding a single JSON array of items.
+	InputTypeJSON ItemInputType = "JSON"
+	// InputTypeJSONL is a file holding one JSON value per line.
+	InputTypeJSONL ItemInputType = "JSONL"
+	// InputTypeCSV is a CSV file. Each row becomes an object that maps the
+	// column names to the values of the row, as strings.
+	InputTypeCSV ItemInputType = "CSV"
+)
+
+// CSVHeaderLocation tells an ItemReader where the column names of a CSV file
+// come from.
+type CSVHeaderLocation string
+
+const (
+	// CSVHeaderFirstRow takes the column names from the first row of the file.
+	CSVHeaderFirstRow CSVHeaderLocation = "FIRST_ROW"
+	// CSVHeaderGiven takes the column names from CSVHeaders. Every row of the
+	// file is an item.
+	CSVHeaderGiven CSVHeaderLocation = "GIVEN"
+)
+
+// ItemReader reads the items of a Map state from a local file instead of
+// its input. A Map state with an ItemReader needs a MaxConcurrency: items are
+// read one at a time as its workers become free, so the file is not loaded
+// ahead of the iterations. The state still keeps the output of every
+// iteration until it finishes. The execution history also keeps the input,
+// output and nested history of every iteration, so large files should be
+// processed by executions started WithHistory(false).
+type ItemReader struct {
+	// Path is the file the items are read from.
+	Path         string           `json:"Path"`
+	ReaderConfig ItemReaderConfig `json:"ReaderConfig"`
+}
+
+// ItemReaderConfig describes the file of an ItemReader.
+type ItemReaderConfig struct {
+	InputType ItemInputType `json:"InputType"`
+	// CSVHeaderLocation defaults to FIRST_ROW. CSVHeaders are the column
+	// names if it is GIVEN.
+	CSVHeaderLocation CSVHeaderLocation `json:"CSVHeaderLocation,omitempty"`
+	CSVHeaders        []string          `json:"CSVHeaders,omitempty"`
+	// MaxItems limits how many items are read. Zero means all of them.
+	MaxItems int `json:"MaxItems,omitempty"`
+}
+
+func (r *ItemReader) validate() error {
+	config := r.ReaderConfig
+	if r.Path == "" {
+		return fmt.Errorf("ItemReader: Path is required")
+	}
+	switch config.InputType {
+	case InputTypeJSON, InputTypeJSONL, InputTypeCSV:
+	default:
+		return fmt.Errorf("ItemReader: unknown InputType '%s'", config.InputType)
+	}
+	if config.InputType != InputTypeCSV && (config.CSVHeaderLocation != "" || len(config.CSVHeaders) > 0) {
+		return fmt.Errorf("ItemReader: CSVHeaderLocation and CSVHeaders only apply to CSV files")
+	}
+	switch config.CSVHeaderLocation {
+	case "", CSVHeaderFirstRow:
+		if len(config.CSVHeaders) > 0 {
+			return fmt.Errorf("ItemReader: CSVHeaders requires CSVHeaderLocation GIVEN")
+		}
+	case CSVHeaderGiven:
+		if err := validateCSVHeaders(config.CSVHeaders); err != nil {
+			return fmt.Errorf("ItemReader: %w", err)
+		}
+	default:
+		return fmt.Errorf("ItemReader: unknown CSVHeaderLocation '%s'", config.CSVHeaderLocation)
+	}
+	if config.MaxItems < 0 {
+		return fmt.Errorf("ItemReader: MaxItems must not be negative")
+	}
+	return nil
+}
+
+func validateCSVHeaders(headers []string) error {
+	if len(headers) == 0 {
+		return fmt.Errorf("CSV headers are missing")
+	}
+	seen := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		if header == "" {
+			return fmt.Errorf("CSV headers must not be empty")
+		}
+		if seen[header] {
+			return fmt.Errorf("duplicate CSV header '%s'", header)
+		}
+		seen[header] = true
+	}
+	return nil
+}
+
+// read passes the items of the file to yield until it returns false, the
+// file ends or MaxItems items were read.
+func (r *ItemReader) read(yield func(item any) bool) error {
+	f, err := os.Open(r.Path)
+	if err != nil {
+		return fmt.Errorf("ItemReader: %w", err)
+	}
+	defer f.Close()
+
+	if maxItems := r.ReaderConfig.MaxItems; maxItems > 0 {
+		next, read := yield, 0
+		yield = func(item any) bool {
+			read++
+			return next(item) && read < maxItems
+		}
+	}
+	switch r.ReaderConfig.InputType {
+	case InputTypeJSON:
+		err = readJSONItems(f, yield)
+	case InputTypeJSONL:
+		err = readJSONLItems(f, yield)
+	case InputTypeCSV:
+		err = r.readCSVItems(f, yield)
+	}
+	if err != nil {
+		return fmt.Errorf("ItemReader: reading '%s': %w", r.Path, err)
+	}
+	return nil
+}
+
+func readJSONItems(r io.Reader, yield func(item any) bool) error {
+	dec := json.NewDecoder(r)
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected a JSON array")
+	}
+	for dec.More() {
+		var item any
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		if !yield(item) {
+			return nil
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+func readJSONLItems(r io.Reader, yield func(item any) bool) error {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			var item any
+			if err := json.Unmarshal(data, &item); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if !yield(item) {
+				return nil
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (r *ItemReader) readCSVItems(f io.Reader, yield func(item any) bool) error {
+	cr := csv.NewReader(f)
+	headers := r.ReaderConfig.CSVHeaders
+	if r.ReaderConfig.CSVHeaderLocation == CSVHeaderGiven {
+		cr.FieldsPerRecord = len(headers)
+	} else {
+		// The header row also sets the number of fields of every other row.
+		first, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		first[0] = strings.TrimPrefix(first[0], "\ufeff")
+		if err := validateCSVHeaders(first); err != nil {
+			return err
+		}
+		headers = first
+	}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item := make(map[string]any, len(headers))
+		for i, header := range headers {
+			item[header] = record[i]
+		}
+		if !yield(item) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package statemachine
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stepKind identifies one segment of a JSONPath expression.
+type stepKind int
+
+const (
+	stepField stepKind = iota
+	stepIndex
+	stepSlice
+	stepWildcard
+)
+
+// pathStep is a single segment of a compiled JSONPath, such as ".name",
+// "[2]", "[1:3]" or "[*]".
+type pathStep struct {
+	kind       stepKind
+	field      string
+	index      int
+	start, end *int
+}
+
+// jsonPath is a compiled JSONPath expression. Paths starting with "$$" are
+// evaluated against the context object instead of the state data.
+type jsonPath struct {
+	raw     string
+	context bool
+	steps   []pathStep
+}
+
+// compilePath parses a JSONPath expression. Supported syntax is the root
+// ("$" or "$$"), dot and bracket field access ($.a.b, $['a']), array
+// indexes including negative ones ($.a[0], $.a[-1]), slices ($.a[1:3]) and
+// wildcards ($.a[*], $.a.*).
+func compilePath(path string) (*jsonPath, error) {
+	p := &jsonPath{raw: path}
+	var rest string
+	switch {
+	case path == "":
+		return p, nil
+	case strings.HasPrefix(path, "$$"):
+		p.context = true
+		rest = path[2:]
+	case strings.HasPrefix(path, "$"):
+		rest = path[1:]
+	default:
+		return nil, fmt.Errorf("invalid path '%s': must start with '$'", path)
+	}
+
+	for rest != "" {
+		var step pathStep
+		var err error
+		switch rest[0] {
+		case '.':
+			step, rest, err = parseDotStep(rest[1:])
+		case '[':
+			step, rest, err = parseBracketStep(rest[1:])
+		default:
+			err = fmt.Errorf("unexpected character '%c'", rest[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid path '%s': %w", path, err)
+		}
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+func parseDotStep(s string) (pathStep, string, error) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	name := s[:end]
+	switch name {
+	case "":
+		return pathStep{}, "", fmt.Errorf("empty field name")
+	case "*":
+		return pathStep{kind: stepWildcard}, s[end:], nil
+	}
+	return pathStep{kind: stepField, field: name}, s[end:], nil
+}
+
+func parseBracketStep(s string) (pathStep, string, error) {
+	if s != "" && (s[0] == '\'' || s[0] == '"') {
+		quote := s[0]
+		end := strings.IndexByte(s[1:], quote)
+		if end < 0 || len(s) < end+3 || s[end+2] != ']' {
+			return pathStep{}, "", fmt.Errorf("unterminated quoted field")
+		}
+		return pathStep{kind: stepField, field: s[1 : end+1]}, s[end+3:], nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return pathStep{}, "", fmt.Errorf("missing ']'")
+	}
+	inner, rest := strings.TrimSpace(s[:end]), s[end+1:]
+
+	if inner == "*" {
+		return pathStep{kind: stepWildcard}, rest, nil
+	}
+	if from, to, ok := strings.Cut(inner, ":"); ok {
+		step := pathStep{kind: stepSlice}
+		var err error
+		if step.start, err = parseSliceBound(from); err != nil {
+			return pathStep{}, "", err
+		}
+		if step.end, err = parseSliceBound(to); err != nil {
+			return pathStep{}, "", err
+		}
+		return step, rest, nil
+	}
+	index, err := strconv.Atoi(inner)
+	if err != nil {
+		return pathStep{}, "", fmt.Errorf("invalid array index '%s'", inner)
+	}
+	return pathStep{kind: stepIndex, index: index}, rest, nil
+}
+
+func parseSliceBound(s string) (*int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid slice bound '%s'", s)
+	}
+	return &n, nil
+}
+
+// definite reports whether the path selects at most one value, that is, it
+// contains no wildcards or slices.
+func (p *jsonPath) definite() bool {
+	for _, step := range p.steps {
+		if step.kind == stepWildcard || step.kind == stepSlice {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate resolves the path. Definite paths return the single value they
+// point at and fail if it does not exist; other paths return a slice of all
+// matching values, which may be empty.
+func (p *jsonPath) evaluate(data, contextObject any) (any, error) {
+	root := data
+	if p.context {
+		root = contextObject
+	}
+	if p.definite() {
+		current := root
+		for _, step := range p.steps {
+			next, err := p.resolveStep(current, step)
+			if err != nil {
+				return nil, err
+			}
+			current = next
+		}
+		return current, nil
+	}
+
+	nodes := []any{root}
+	for _, step := range p.steps {
+		var matched []any
+		for _, node := range nodes {
+			matched = append(matched, p.expandStep(node, step)...)
+		}
+		nodes = matched
+	}
+	if nodes == nil {
+		nodes = []any{}
+	}
+	return nodes, nil
+}
+
+func (p *jsonPath) resolveStep(current any, step pathStep) (any, error) {
+	switch step.kind {
+	case stepField:
+		obj, ok := current.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("path '%s': cannot read field '%s' of %s", p.raw, step.field, typeName(current))
+		}
+		value, ok := obj[step.field]
+		if !ok {
+			return nil, fmt.Errorf("path '%s': field '%s' not found", p.raw, step.field)
+		}
+		return value, nil
+	default:
+		arr, ok := current.([]any)
+		if !ok {
+			return nil, fmt.Errorf("path '%s': cannot index %s", p.raw, typeName(current))
+		}
+		i := step.index
+		if i < 0 {
+			i += len(arr)
+		}
+		if i < 0 || i >= len(arr) {
+			return nil, fmt.Errorf("path '%s': index %d out of range for array of length %d", p.raw, step.index, len(arr))
+		}
+		return arr[i], nil
+	}
+}
+
+func (p *jsonPath) expandStep(node any, step pathStep) []any {
+	switch step.kind {
+	case stepWildcard:
+		switch v := node.(type) {
+		case []any:
+			return v
+		case map[string]any:
+			out := make([]any, 0, len(v))
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				out = append(out, v[key])
+			}
+			return out
+		}
+		return nil
+	case stepSlice:
+		arr, ok := node.([]any)
+		if !ok {
+			return nil
+		}
+		start, end := sliceBound(step.start, 0, len(arr)), sliceBound(step.end, len(arr), len(arr))
+		if start >= end {
+			return nil
+		}
+		return arr[start:end]
+	default:
+		value, err := p.resolveStep(node, step)
+		if err != nil {
+			return nil
+		}
+		return []any{value}
+	}
+}
+
+func sliceBound(bound *int, def, length int) int {
+	if bound == nil {
+		return def
+	}
+	i := *bound
+	if i < 0 {
+		i += length
+	}
+	return max(0, min(i, length))
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
@@ -0,0 +1,68 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// discardHandler is the slog.Handler behind the default, silent logger.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+// WithLogger sets the logger of the execution. Records carry the execution
+// ID and, inside states, the state name and type. Executions are silent
+// unless a logger is set.
+func WithLogger(logger *slog.Logger) ExecutionOption {
+	return func(e *Execution) {
+		if logger != nil {
+			e.logger = logger
+		}
+	}
+}
+
+type loggerKey struct{}
+
+// LoggerFromContext returns the logger of the state running in ctx, so task
+// functions can log with the same execution and state fields. Outside of an
+// execution it returns a logger that discards everything.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return discardLogger
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// stateType returns the type name of a state as used in JSON definitions.
+func stateType(state State) string {
+	switch state.(type) {
+	case *TaskState:
+		return "Task"
+	case *PassState:
+		return "Pass"
+	case *ChoiceState:
+		return "Choice"
+	case *WaitState:
+		return "Wait"
+	case *MapState:
+		return "Map"
+	case *ParallelState:
+		return "Parallel"
+	case *FailState:
+		return "Fail"
+	case *EndState:
+		return "End"
+	default:
+		return fmt.Sprintf("%T", state)
+	}
+}
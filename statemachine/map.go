@@ -2,17 +2,33 @@ package statemachine
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // MapState iterates over an array and executes a sub-workflow for each item.
 type MapState struct {
-	name   string
-	input  string
-	result string
-	next   string
-	branch *StateMachine
+	name      string
+	itemsPath string
+	next      string
+	branch    *StateMachine
+	catches   []CatchRule
+	dataFlow  DataFlow
+	// maxConcurrency is the number of iterations that may run at the same
+	// time. Zero means no limit.
+	maxConcurrency int
+	// toleratedFailureCount and toleratedFailurePercentage let the state
+	// succeed although some iterations failed. Zero means not set.
+	toleratedFailureCount      int
+	toleratedFailurePercentage float64
+	// itemSelector is a template that builds the input of each iteration.
+	// Parameters is used if it is not set, and {"item": value} if neither is.
+	itemSelector map[string]any
+	// itemReader reads the items from a file instead of ItemsPath.
+	itemReader *ItemReader
 }
 
 func (s *MapState) GetName() string {
@@ -20,45 +36,346 @@ func (s *MapState) GetName() string {
 }
 
 func (s *MapState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("Executing MapState: %s\n", s.name)
-
-	inputArray, ok := sc.Data[s.input].([]any)
-	if !ok {
-		return nil, fmt.Errorf("input '%s' is not an array", s.input)
+	input, err := s.dataFlow.filterInput(ctx, sc.Data)
+	if err != nil {
+		return nil, err
 	}
+	items, count, err := s.items(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	// Once the state is bound to fail, the iterations that are still running
+	// are cancelled and no more items are started.
+	iterationCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(inputArray))
-	mapOutput := make([]any, len(inputArray))
+	var failed atomic.Int64
+	results := &mapResults{}
+	progress := &mapProgress{}
+	progress.total.Store(int64(max(count, 0)))
+	run := func(job mapJob) {
+		if iterationCtx.Err() != nil {
+			return
+		}
+		output, err := s.runIteration(iterationCtx, input, job.item, job.index, progress)
+		results.set(job.index, output, err)
+		if err != nil && !s.tolerates(int(failed.Add(1)), count) {
+			cancel(errSiblingFailed)
+		}
+	}
 
-	for i, item := range inputArray {
+	// A pool of maxConcurrency workers takes the items in order. Items are
+	// handed out one at a time, so an ItemReader, which always has a
+	// maxConcurrency, only reads ahead of the iterations by one item.
+	workers := s.maxConcurrency
+	if count >= 0 {
+		workers = min(workers, count)
+	}
+	jobs := make(chan mapJob)
+	for range workers {
 		wg.Add(1)
-		go func(itemData any, index int) {
+		go func() {
 			defer wg.Done()
-
-			branchCtx := &StateContext{Data: map[string]any{"item": itemData}}
-
-			branchCopy := *s.branch
-			branchCopy.currentState = branchCopy.states[branchCopy.startAt]
-
-			err := branchCopy.Run(ctx, branchCtx.Data)
-			if err != nil {
-				errChan <- fmt.Errorf("map iteration %d failed: %w", index, err)
-				return
+			for job := range jobs {
+				run(job)
 			}
-			mapOutput[index] = branchCopy.Context.Data
-		}(item, i)
+		}()
 	}
+	LoggerFromContext(ctx).Debug("map state starting iterations", "iterations", count, "workers", workers)
 
+	read := 0
+	readErr := items(func(item any) bool {
+		if iterationCtx.Err() != nil {
+			return false
+		}
+		job := mapJob{index: read, item: item}
+		read++
+		if count < 0 {
+			progress.total.Add(1)
+		}
+		if s.maxConcurrency == 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run(job)
+			}()
+			return true
+		}
+		select {
+		case jobs <- job:
+			return true
+		case <-iterationCtx.Done():
+			return false
+		}
+	})
+	close(jobs)
+	if readErr != nil {
+		cancel(readErr)
+	}
 	wg.Wait()
-	close(errChan)
 
-	if err := <-errChan; err != nil {
+	mapOutput, iterationErrs := results.slices(read)
+	if readErr != nil {
+		err = readErr
+	} else {
+		failedFast := errors.Is(context.Cause(iterationCtx), errSiblingFailed)
+		err = s.failure(ctx, iterationErrs, mapOutput, failedFast)
+	}
+	if err == nil && ctx.Err() != nil {
+		// The execution was cancelled before every item could run.
+		err = ctx.Err()
+	}
+	if err != nil {
+		if next, caught, catchErr := catchError(ctx, s, s.catches, sc, machine, err); caught || catchErr != nil {
+			return next, catchErr
+		}
 		return nil, err
 	}
 
-	sc.Data[s.result] = mapOutput
+	flow := s.dataFlow
+	if flow.ResultPath == "" {
+		// Like Parallel states, Map states keep their results under a key by
+		// default, as the array cannot replace the state data.
+		flow.ResultPath = "$.map_output"
+	}
+	output, err := flow.stateOutput(ctx, sc.Data, mapOutput)
+	if err != nil {
+		return nil, err
+	}
+	sc.Data = output
 
-	fmt.Println("Map state finished all iterations.")
+	LoggerFromContext(ctx).Debug("map state finished all iterations", "iterations", read)
 	return machine.GetState(s.next), nil
 }
+
+// items returns a function that passes the items of the state to yield, from
+// its ItemReader or from the array at ItemsPath, and the number of items, or
+// -1 if it is only known once they were all read.
+func (s *MapState) items(ctx context.Context, input any) (func(yield func(item any) bool) error, int, error) {
+	if s.itemReader != nil {
+		return s.itemReader.read, -1, nil
+	}
+	items, err := getPath(ctx, input, s.itemsPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("ItemsPath: %w", err)
+	}
+	inputArray, ok := items.([]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("items at '%s' are not an array", s.itemsPath)
+	}
+	return func(yield func(item any) bool) error {
+		for _, item := range inputArray {
+			if !yield(item) {
+				break
+			}
+		}
+		return nil
+	}, len(inputArray), nil
+}
+
+type mapJob struct {
+	index int
+	item  any
+}
+
+// mapResults collects the outputs and errors of iterations, whose number is
+// not known in advance when the items come from an ItemReader.
+type mapResults struct {
+	mu      sync.Mutex
+	outputs []any
+	errs    []error
+}
+
+func (r *mapResults) set(index int, output map[string]any, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grow(index + 1)
+	if err != nil {
+		r.errs[index] = err
+		return
+	}
+	r.outputs[index] = output
+}
+
+// slices returns the outputs and errors of the first n iterations. Items that
+// were skipped have neither.
+func (r *mapResults) slices(n int) ([]any, []error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grow(n)
+	return r.outputs[:n], r.errs[:n]
+}
+
+func (r *mapResults) grow(n int) {
+	for len(r.outputs) < n {
+		r.outputs = append(r.outputs, nil)
+		r.errs = append(r.errs, nil)
+	}
+}
+
+// failure returns the error the state fails with given the errors of its
+// iterations, or nil if none failed or the failures are tolerated. The output
+// of a failed iteration is replaced by its error output. If failedFast is
+// set, iterations that were cancelled because another one failed do not
+// count as failures.
+func (s *MapState) failure(ctx context.Context, iterationErrs []error, mapOutput []any, failedFast bool) error {
+	var errs []error
+	for index, err := range iterationErrs {
+		if err == nil {
+			continue
+		}
+		mapOutput[index] = errorOutput(err)
+		if failedFast && errors.Is(err, context.Canceled) {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("map iteration %d failed: %w", index, err))
+	}
+	total := len(iterationErrs)
+	if s.tolerates(len(errs), total) {
+		if len(errs) > 0 {
+			LoggerFromContext(ctx).Warn("map iterations failed within the tolerated threshold", "failed", len(errs), "iterations", total)
+		}
+		return nil
+	}
+	if s.toleratedFailureCount == 0 && s.toleratedFailurePercentage == 0 {
+		return errors.Join(errs...)
+	}
+	return errors.Join(fmt.Errorf("%d of %d map iterations failed: %w", len(errs), total, ErrToleratedFailureThreshold), errors.Join(errs...))
+}
+
+// tolerates reports whether the state succeeds although failed of its total
+// iterations failed. While the items of an ItemReader are read, total is -1
+// and the percentage is only checked once all of them ran.
+func (s *MapState) tolerates(failed, total int) bool {
+	if failed == 0 {
+		return true
+	}
+	if s.toleratedFailureCount == 0 && s.toleratedFailurePercentage == 0 {
+		return false
+	}
+	if s.toleratedFailureCount > 0 && failed > s.toleratedFailureCount {
+		return false
+	}
+	return s.toleratedFailurePercentage == 0 || total < 0 || float64(failed)*100 <= s.toleratedFailurePercentage*float64(total)
+}
+
+// mapProgress counts the iterations of a Map state that are running and
+// that are still waiting for a worker. With an ItemReader, total only counts
+// the items read so far.
+type mapProgress struct {
+	total    atomic.Int64
+	started  atomic.Int64
+	inFlight atomic.Int64
+}
+
+// start records that an iteration started and returns the counts after it.
+func (p *mapProgress) start() (inFlight, queued int) {
+	started := p.started.Add(1)
+	return int(p.inFlight.Add(1)), int(p.total.Load() - started)
+}
+
+// finish records that an iteration stopped and returns the counts after it.
+func (p *mapProgress) finish() (inFlight, queued int) {
+	return int(p.inFlight.Add(-1)), int(p.total.Load() - p.started.Load())
+}
+
+// mapItemKey is the context key of the item an iteration input is built for.
+type mapItemKey struct{}
+
+type mapItem struct {
+	index int
+	value any
+}
+
+// selector returns the template that builds the input of each iteration.
+func (s *MapState) selector() map[string]any {
+	if s.itemSelector != nil {
+		return s.itemSelector
+	}
+	return s.dataFlow.Parameters
+}
+
+// iterationInput builds the input of the iteration for item from the
+// ItemSelector, which can refer to the state input with "$" paths and to the
+// item with $$.Map.Item.Index and $$.Map.Item.Value.
+func (s *MapState) iterationInput(ctx context.Context, input any, item any, index int) (map[string]any, error) {
+	selector := s.selector()
+	if selector == nil {
+		return map[string]any{"item": item}, nil
+	}
+	ctx = context.WithValue(ctx, mapItemKey{}, mapItem{index: index, value: item})
+	iterationInput, err := applyTemplate(ctx, selector, input)
+	if err != nil {
+		return nil, fmt.Errorf("ItemSelector: %w", err)
+	}
+	return iterationInput, nil
+}
+
+// runIteration runs the branch for one item. A panic is returned as a
+// PanicError.
+func (s *MapState) runIteration(ctx context.Context, input any, item any, index int, progress *mapProgress) (output map[string]any, err error) {
+	childName := fmt.Sprintf("%s/%d", s.name, index)
+	childID := childExecutionID(ctx, childName)
+	inFlight, queued := progress.start()
+	emitStateEvent(ctx, s, Event{Type: EventMapIterationStarted, Index: index, ChildExecutionID: childID, InFlight: inFlight, Queued: queued})
+	started := time.Now()
+
+	var exec *Execution
+	defer func() {
+		inFlight, queued := progress.finish()
+		if err != nil {
+			emitStateEvent(ctx, s, Event{Type: EventMapIterationFailed, Index: index, ChildExecutionID: childID, Error: err, Duration: time.Since(started), InFlight: inFlight, Queued: queued, child: exec})
+			return
+		}
+		emitStateEvent(ctx, s, Event{Type: EventMapIterationSucceeded, Index: index, ChildExecutionID: childID, Output: output, Duration: time.Since(started), InFlight: inFlight, Queued: queued, child: exec})
+	}()
+	defer recoverPanic(&err)
+
+	iterationInput, err := s.iterationInput(ctx, input, item, index)
+	if err != nil {
+		return nil, err
+	}
+	exec, err = s.branch.Run(ctx, iterationInput, childOptions(ctx, childName)...)
+	if err != nil {
+		return nil, err
+	}
+	return exec.Output(), nil
+}
+
+func (s *MapState) validate() error {
+	if s.maxConcurrency < 0 {
+		return fmt.Errorf("map state '%s': MaxConcurrency must not be negative", s.name)
+	}
+	if s.toleratedFailureCount < 0 {
+		return fmt.Errorf("map state '%s': ToleratedFailureCount must not be negative", s.name)
+	}
+	if s.toleratedFailurePercentage < 0 || s.toleratedFailurePercentage > 100 {
+		return fmt.Errorf("map state '%s': ToleratedFailurePercentage must be between 0 and 100", s.name)
+	}
+	if s.itemReader != nil {
+		if err := s.itemReader.validate(); err != nil {
+			return fmt.Errorf("map state '%s': %w", s.name, err)
+		}
+		if s.maxConcurrency == 0 {
+			return fmt.Errorf("map state '%s': an ItemReader requires MaxConcurrency, so that items are not read faster than they are processed", s.name)
+		}
+	}
+	if s.itemSelector != nil && s.dataFlow.Parameters != nil {
+		return fmt.Errorf("map state '%s': ItemSelector and Parameters cannot both be set", s.name)
+	}
+	if _, err := compilePath(s.itemsPath); err != nil {
+		return fmt.Errorf("map state '%s': ItemsPath: %w", s.name, err)
+	}
+	if err := validateTemplate(s.itemSelector); err != nil {
+		return fmt.Errorf("map state '%s': ItemSelector: %w", s.name, err)
+	}
+	if err := s.dataFlow.validate(); err != nil {
+		return fmt.Errorf("map state '%s': %w", s.name, err)
+	}
+	if err := validateCatches(s.catches); err != nil {
+		return fmt.Errorf("map state '%s': %w", s.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package statemachine
+
+import (
+	"fmt"
+	"time"
+)
+
+// StateOption configures a state added with one of the Add methods of
+// StateMachineBuilder. Passing an option to a type of state it does not apply
+// to makes Build fail. RetryRule and CatchRule values are options too, the
+// same as WithRetry and WithCatch with a single rule.
+type StateOption interface {
+	applyState(state State) error
+}
+
+type stateOption func(state State) error
+
+func (f stateOption) applyState(state State) error {
+	return f(state)
+}
+
+func notApplicable(option string, state State) error {
+	return fmt.Errorf("%s does not apply to %s states", option, stateType(state))
+}
+
+// WithRetry adds retry rules to a Task state.
+func WithRetry(rules ...RetryRule) StateOption {
+	return stateOption(func(state State) error {
+		task, ok := state.(*TaskState)
+		if !ok {
+			return notApplicable("WithRetry", state)
+		}
+		task.retries = append(task.retries, rules...)
+		return nil
+	})
+}
+
+func (r RetryRule) applyState(state State) error {
+	return WithRetry(r).applyState(state)
+}
+
+// WithCatch adds catch rules to a Task, Map or Parallel state.
+func WithCatch(rules ...CatchRule) StateOption {
+	return stateOption(func(state State) error {
+		switch s := state.(type) {
+		case *TaskState:
+			s.catches = append(s.catches, rules...)
+		case *MapState:
+			s.catches = append(s.catches, rules...)
+		case *ParallelState:
+			s.catches = append(s.catches, rules...)
+		default:
+			return notApplicable("WithCatch", state)
+		}
+		return nil
+	})
+}
+
+func (r CatchRule) applyState(state State) error {
+	return WithCatch(r).applyState(state)
+}
+
+// WithTimeout limits how long each attempt of a Task state may run.
+func WithTimeout(timeout time.Duration) StateOption {
+	return stateOption(func(state State) error {
+		task, ok := state.(*TaskState)
+		if !ok {
+			return notApplicable("WithTimeout", state)
+		}
+		task.timeout = timeout
+		return nil
+	})
+}
+
+// WithTimeoutSecondsPath reads the timeout of a Task state, in seconds, from
+// its effective input when the state runs.
+func WithTimeoutSecondsPath(path string) StateOption {
+	return stateOption(func(state State) error {
+		task, ok := state.(*TaskState)
+		if !ok {
+			return notApplicable("WithTimeoutSecondsPath", state)
+		}
+		task.timeoutPath = path
+		return nil
+	})
+}
+
+// WithHeartbeat fails an attempt of a Task state if its function does not
+// call SendHeartbeat at least this often.
+func WithHeartbeat(interval time.Duration) StateOption {
+	return stateOption(func(state State) error {
+		task, ok := state.(*TaskState)
+		if !ok {
+			return notApplicable("WithHeartbeat", state)
+		}
+		task.heartbeat = interval
+		return nil
+	})
+}
+
+// WithMaxConcurrency limits how many iterations of a Map state run at the
+// same time. Zero means no limit.
+func WithMaxConcurrency(n int) StateOption {
+	return stateOption(func(state State) error {
+		m, ok := state.(*MapState)
+		if !ok {
+			return notApplicable("WithMaxConcurrency", state)
+		}
+		m.maxConcurrency = n
+		return nil
+	})
+}
+
+// WithToleratedFailureCount lets a Map state succeed as long as no more
+// than n of its iterations fail. The result of a failed iteration is its
+// error output.
+func WithToleratedFailureCount(n int) StateOption {
+	return stateOption(func(state State) error {
+		m, ok := state.(*MapState)
+		if !ok {
+			return notApplicable("WithToleratedFailureCount", state)
+		}
+		m.toleratedFailureCount = n
+		return nil
+	})
+}
+
+// WithToleratedFailurePercentage lets a Map state succeed as long as no more
+// than percentage percent of its iterations fail.
+func WithToleratedFailurePercentage(percentage float64) StateOption {
+	return stateOption(func(state State) error {
+		m, ok := state.(*MapState)
+		if !ok {
+			return notApplicable("WithToleratedFailurePercentage", state)
+		}
+		m.toleratedFailurePercentage = percentage
+		return nil
+	})
+}
+
+// WithItemSelector sets the template that builds the input of each iteration
+// of a Map state from the state input, $$.Map.Item.Index and
+// $$.Map.Item.Value.
+func WithItemSelector(selector map[string]any) StateOption {
+	return stateOption(func(state State) error {
+		m, ok := state.(*MapState)
+		if !ok {
+			return notApplicable("WithItemSelector", state)
+		}
+		m.itemSelector = selector
+		return nil
+	})
+}
+
+// WithItemReader makes a Map state read its items from a file instead of its
+// input.
+func WithItemReader(reader ItemReader) StateOption {
+	return stateOption(func(state State) error {
+		m, ok := state.(*MapState)
+		if !ok {
+			return notApplicable("WithItemReader", state)
+		}
+		m.itemReader = &reader
+		return nil
+	})
+}
+
+// AsEnd makes the execution succeed after the state, instead of moving to
+// its next state.
+func AsEnd() StateOption {
+	return stateOption(func(state State) error {
+		switch s := state.(type) {
+		case *TaskState:
+			s.end = true
+		case *PassState:
+			s.next = ""
+		case *WaitState:
+			s.next = ""
+		case *MapState:
+			s.next = ""
+		case *ParallelState:
+			s.next = ""
+		default:
+			return notApplicable("AsEnd", state)
+		}
+		return nil
+	})
+}
+
+// WithDataFlow replaces the input and output processing of a state.
+func WithDataFlow(flow DataFlow) StateOption {
+	return dataFlowOption("WithDataFlow", func(f *DataFlow) { *f = flow })
+}
+
+// WithInputPath sets the InputPath of a state.
+func WithInputPath(path string) StateOption {
+	return dataFlowOption("WithInputPath", func(f *DataFlow) { f.InputPath = path })
+}
+
+// WithParameters sets the Parameters template of a state.
+func WithParameters(parameters map[string]any) StateOption {
+	return dataFlowOption("WithParameters", func(f *DataFlow) { f.Parameters = parameters })
+}
+
+// WithResultSelector sets the ResultSelector template of a state.
+func WithResultSelector(selector map[string]any) StateOption {
+	return dataFlowOption("WithResultSelector", func(f *DataFlow) { f.ResultSelector = selector })
+}
+
+// WithResultPath sets the ResultPath of a state.
+func WithResultPath(path string) StateOption {
+	return dataFlowOption("WithResultPath", func(f *DataFlow) { f.ResultPath = path })
+}
+
+// WithOutputPath sets the OutputPath of a state.
+func WithOutputPath(path string) StateOption {
+	return dataFlowOption("WithOutputPath", func(f *DataFlow) { f.OutputPath = path })
+}
+
+// dataFlowOption returns an option that modifies the DataFlow of a state.
+// Choice and Wait states only accept InputPath and OutputPath.
+func dataFlowOption(name string, modify func(*DataFlow)) StateOption {
+	return stateOption(func(state State) error {
+		var flow *DataFlow
+		pathsOnly := false
+		switch s := state.(type) {
+		case *TaskState:
+			flow = &s.dataFlow
+		case *PassState:
+			flow = &s.dataFlow
+		case *ChoiceState:
+			flow, pathsOnly = &s.dataFlow, true
+		case *WaitState:
+			flow, pathsOnly = &s.dataFlow, true
+		case *MapState:
+			flow = &s.dataFlow
+		case *ParallelState:
+			flow = &s.dataFlow
+		default:
+			return notApplicable(name, state)
+		}
+		updated := *flow
+		modify(&updated)
+		if pathsOnly {
+			if err := updated.validatePathsOnly(state); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		*flow = updated
+		return nil
+	})
+}
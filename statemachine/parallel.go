@@ -2,8 +2,10 @@ package statemachine
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // ParallelState executes multiple independent branches concurrently.
@@ -11,41 +13,108 @@ type ParallelState struct {
 	name     string
 	branches []*StateMachine
 	next     string
+	catches  []CatchRule
+	dataFlow DataFlow
 }
 
 func (s *ParallelState) GetName() string {
 	return s.name
 }
 
+func (s *ParallelState) validate() error {
+	if err := s.dataFlow.validate(); err != nil {
+		return fmt.Errorf("parallel state '%s': %w", s.name, err)
+	}
+	if err := validateCatches(s.catches); err != nil {
+		return fmt.Errorf("parallel state '%s': %w", s.name, err)
+	}
+	return nil
+}
+
 func (s *ParallelState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("Executing ParallelState: %s\n", s.name)
+	input, err := s.dataFlow.effectiveInput(ctx, sc.Data)
+	if err != nil {
+		return nil, err
+	}
+	branchInput, ok := input.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("effective input must be a JSON object, got %T", input)
+	}
+
+	// The first branch to fail cancels the others.
+	branchCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(s.branches))
+	branchErrs := make([]error, len(s.branches))
 	branchOutputs := make([]any, len(s.branches))
 
 	for i, branch := range s.branches {
 		wg.Add(1)
 		go func(branch *StateMachine, index int) {
 			defer wg.Done()
-			branchCopy := *branch
-			branchCopy.currentState = branchCopy.states[branchCopy.startAt]
-			err := branchCopy.Run(ctx, make(map[string]any))
+			output, err := s.runBranch(branchCtx, branch, branchInput, index)
 			if err != nil {
-				errChan <- fmt.Errorf("parallel branch %d failed: %w", index, err)
+				branchErrs[index] = err
+				cancel(errSiblingFailed)
 				return
 			}
-			branchOutputs[index] = branchCopy.Context.Data
+			branchOutputs[index] = output
 		}(branch, i)
 	}
 
 	wg.Wait()
-	close(errChan)
 
-	if err := <-errChan; err != nil {
+	// Branches that were cancelled because another one failed are not
+	// reported as failures of their own.
+	failedFast := errors.Is(context.Cause(branchCtx), errSiblingFailed)
+	var errs []error
+	for index, err := range branchErrs {
+		if err != nil && !(failedFast && errors.Is(err, context.Canceled)) {
+			errs = append(errs, fmt.Errorf("parallel branch %d failed: %w", index, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		if next, caught, catchErr := catchError(ctx, s, s.catches, sc, machine, err); caught || catchErr != nil {
+			return next, catchErr
+		}
 		return nil, err
 	}
 
-	sc.Data["parallel_output"] = branchOutputs
-	fmt.Println("Parallel state finished all branches.")
+	flow := s.dataFlow
+	if flow.ResultPath == "" {
+		// Branch outputs have always been kept under "parallel_output".
+		flow.ResultPath = "$.parallel_output"
+	}
+	output, err := flow.stateOutput(ctx, sc.Data, branchOutputs)
+	if err != nil {
+		return nil, err
+	}
+	sc.Data = output
+	LoggerFromContext(ctx).Debug("parallel state finished all branches", "branches", len(s.branches))
 	return machine.GetState(s.next), nil
 }
+
+// runBranch runs one branch. A panic is returned as a PanicError.
+func (s *ParallelState) runBranch(ctx context.Context, branch *StateMachine, input map[string]any, index int) (output map[string]any, err error) {
+	childName := fmt.Sprintf("%s/%d", s.name, index)
+	childID := childExecutionID(ctx, childName)
+	emitStateEvent(ctx, s, Event{Type: EventParallelBranchStarted, Index: index, ChildExecutionID: childID})
+	started := time.Now()
+
+	var exec *Execution
+	defer func() {
+		if err != nil {
+			emitStateEvent(ctx, s, Event{Type: EventParallelBranchFailed, Index: index, ChildExecutionID: childID, Error: err, Duration: time.Since(started), child: exec})
+			return
+		}
+		emitStateEvent(ctx, s, Event{Type: EventParallelBranchSucceeded, Index: index, ChildExecutionID: childID, Output: output, Duration: time.Since(started), child: exec})
+	}()
+	defer recoverPanic(&err)
+
+	exec, err = branch.Run(ctx, input, childOptions(ctx, childName)...)
+	if err != nil {
+		return nil, err
+	}
+	return exec.Output(), nil
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -20,6 +19,12 @@ func ParseStateMachine(filePath string, tasks map[string]TaskFn) (*StateMachine,
 		return nil, fmt.Errorf("could not unmarshal JSON: %w", err)
 	}
 
+	return parseDefinition(def, tasks)
+}
+
+// parseDefinition builds a StateMachine from a parsed definition. It is also
+// used for nested state machines (like in Map or Parallel states).
+func parseDefinition(def StateMachineDefinition, tasks map[string]TaskFn) (*StateMachine, error) {
 	states := make(map[string]State)
 	for name, rawState := range def.States {
 		var stateType StateType
@@ -34,23 +39,36 @@ func ParseStateMachine(filePath string, tasks map[string]TaskFn) (*StateMachine,
 				return nil, fmt.Errorf("could not unmarshal task state '%s': %w", name, err)
 			}
 			taskDef.Name = name
-			task := &TaskState{name: taskDef.Name, next: taskDef.Next, end: taskDef.End, TimeoutSeconds: taskDef.TimeoutSeconds}
+			timeout, err := taskDef.timeout()
+			if err != nil {
+				return nil, fmt.Errorf("task state '%s': %w", name, err)
+			}
+			task := &TaskState{
+				name:        taskDef.Name,
+				next:        taskDef.Next,
+				end:         taskDef.End,
+				timeout:     timeout,
+				heartbeat:   secondsDuration(taskDef.HeartbeatSeconds),
+				timeoutPath: taskDef.TimeoutSecondsPath,
+				dataFlow:    taskDef.DataFlow,
+			}
 			if taskFn, ok := tasks[name]; ok {
 				task.execute = taskFn
 			}
 
 			for _, rule := range taskDef.Retry {
 				task.retries = append(task.retries, RetryRule{
-					ErrorName:   rule.ErrorEquals[0],
-					Interval:    time.Duration(rule.IntervalSeconds) * time.Second,
-					MaxAttempts: rule.MaxAttempts,
+					ErrorEquals:    rule.ErrorEquals,
+					Interval:       time.Duration(rule.IntervalSeconds) * time.Second,
+					MaxAttempts:    rule.MaxAttempts,
+					BackoffRate:    rule.BackoffRate,
+					MaxDelay:       time.Duration(rule.MaxDelaySeconds) * time.Second,
+					JitterStrategy: rule.JitterStrategy,
 				})
 			}
-			for _, rule := range taskDef.Catch {
-				task.catches = append(task.catches, CatchRule{
-					ErrorName: rule.ErrorEquals[0],
-					NextState: rule.Next,
-				})
+			task.catches = parseCatches(taskDef.Catch)
+			if err := task.validate(); err != nil {
+				return nil, err
 			}
 			states[name] = task
 		case "Pass":
@@ -59,27 +77,38 @@ func ParseStateMachine(filePath string, tasks map[string]TaskFn) (*StateMachine,
 				return nil, fmt.Errorf("could not unmarshal pass state '%s': %w", name, err)
 			}
 			passDef.Name = name
-			states[name] = &PassState{name: passDef.Name, next: passDef.Next}
+			pass := &PassState{name: passDef.Name, next: passDef.Next, dataFlow: passDef.DataFlow}
+			if err := pass.validate(); err != nil {
+				return nil, err
+			}
+			states[name] = pass
 		case "Map":
 			var mapDef MapStateDefinition
 			if err := json.Unmarshal(rawState, &mapDef); err != nil {
 				return nil, fmt.Errorf("could not unmarshal map state '%s': %w", name, err)
 			}
 			mapDef.Name = name
-			inputKey := strings.TrimPrefix(mapDef.InputPath, "$.")
-			resultKey := strings.TrimPrefix(mapDef.ResultPath, "$.")
-
-			subMachine, err := parseSubMachine(mapDef.Iterator, tasks)
+			subMachine, err := parseDefinition(mapDef.Iterator, tasks)
 			if err != nil {
 				return nil, fmt.Errorf("could not parse Map iterator for state '%s': %w", name, err)
 			}
-			states[name] = &MapState{
-				name:   mapDef.Name,
-				input:  inputKey,
-				result: resultKey,
-				next:   mapDef.Next,
-				branch: subMachine,
-			}
+			mapState := &MapState{
+				name:                       mapDef.Name,
+				itemsPath:                  mapDef.ItemsPath,
+				next:                       mapDef.Next,
+				branch:                     subMachine,
+				catches:                    parseCatches(mapDef.Catch),
+				dataFlow:                   mapDef.DataFlow,
+				maxConcurrency:             mapDef.MaxConcurrency,
+				toleratedFailureCount:      mapDef.ToleratedFailureCount,
+				toleratedFailurePercentage: mapDef.ToleratedFailurePercentage,
+				itemSelector:               mapDef.ItemSelector,
+				itemReader:                 mapDef.ItemReader,
+			}
+			if err := mapState.validate(); err != nil {
+				return nil, err
+			}
+			states[name] = mapState
 		case "Choice":
 			var choiceDef ChoiceStateDefinition
 			if err := json.Unmarshal(rawState, &choiceDef); err != nil {
@@ -88,16 +117,34 @@ func ParseStateMachine(filePath string, tasks map[string]TaskFn) (*StateMachine,
 			choiceDef.Name = name
 			var choices []ChoiceRule
 			for _, rule := range choiceDef.Choices {
-				choices = append(choices, ChoiceRule{Condition: rule.Condition, Next: rule.Next})
+				choices = append(choices, ChoiceRule{Variable: rule.Variable, Condition: rule.Condition, Next: rule.Next})
+			}
+			choice := &ChoiceState{name: choiceDef.Name, choices: choices, defaultState: choiceDef.Default, dataFlow: choiceDef.DataFlow}
+			if err := choice.dataFlow.validatePathsOnly(choice); err != nil {
+				return nil, fmt.Errorf("choice state '%s': %w", name, err)
+			}
+			if err := choice.validate(); err != nil {
+				return nil, err
 			}
-			states[name] = &ChoiceState{name: choiceDef.Name, choices: choices, defaultState: choiceDef.Default}
+			states[name] = choice
 		case "Wait":
 			var waitDef WaitStateDefinition
 			if err := json.Unmarshal(rawState, &waitDef); err != nil {
 				return nil, fmt.Errorf("could not unmarshal wait state '%s': %w", name, err)
 			}
 			waitDef.Name = name
-			states[name] = &WaitState{name: waitDef.Name, seconds: waitDef.Seconds, next: waitDef.Next}
+			duration := secondsDuration(waitDef.Seconds)
+			if waitDef.Milliseconds > 0 {
+				duration = time.Duration(waitDef.Milliseconds) * time.Millisecond
+			}
+			wait := &WaitState{name: waitDef.Name, duration: duration, next: waitDef.Next, dataFlow: waitDef.DataFlow}
+			if err := wait.dataFlow.validatePathsOnly(wait); err != nil {
+				return nil, fmt.Errorf("wait state '%s': %w", name, err)
+			}
+			if err := wait.validate(); err != nil {
+				return nil, err
+			}
+			states[name] = wait
 		case "Parallel":
 			var parallelDef ParallelStateDefinition
 			if err := json.Unmarshal(rawState, &parallelDef); err != nil {
@@ -106,13 +153,17 @@ func ParseStateMachine(filePath string, tasks map[string]TaskFn) (*StateMachine,
 			parallelDef.Name = name
 			var branches []*StateMachine
 			for _, branchDef := range parallelDef.Branches {
-				branch, err := parseSubMachine(branchDef, tasks)
+				branch, err := parseDefinition(branchDef, tasks)
 				if err != nil {
 					return nil, fmt.Errorf("could not parse Parallel branch: %w", err)
 				}
 				branches = append(branches, branch)
 			}
-			states[name] = &ParallelState{name: parallelDef.Name, branches: branches, next: parallelDef.Next}
+			parallel := &ParallelState{name: parallelDef.Name, branches: branches, next: parallelDef.Next, catches: parseCatches(parallelDef.Catch), dataFlow: parallelDef.DataFlow}
+			if err := parallel.validate(); err != nil {
+				return nil, err
+			}
+			states[name] = parallel
 		case "End":
 			states[name] = &EndState{name: name}
 		case "Fail":
@@ -122,60 +173,42 @@ func ParseStateMachine(filePath string, tasks map[string]TaskFn) (*StateMachine,
 		}
 	}
 
+	if def.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("TimeoutSeconds must not be negative")
+	}
 	return &StateMachine{
 		states:  states,
 		startAt: def.StartAt,
+		timeout: secondsDuration(def.TimeoutSeconds),
 	}, nil
 }
 
-// parseSubMachine is a helper function for nested state machines (like in Map or Parallel states).
-func parseSubMachine(def StateMachineDefinition, tasks map[string]TaskFn) (*StateMachine, error) {
-	states := make(map[string]State)
-	for name, rawState := range def.States {
-		var stateType StateType
-		if err := json.Unmarshal(rawState, &stateType); err != nil {
-			return nil, fmt.Errorf("could not determine sub-state type for '%s': %w", name, err)
-		}
+func parseCatches(defs []CatchDefinition) []CatchRule {
+	var catches []CatchRule
+	for _, rule := range defs {
+		catches = append(catches, CatchRule{
+			ErrorEquals: rule.ErrorEquals,
+			NextState:   rule.Next,
+			ResultPath:  rule.ResultPath,
+		})
+	}
+	return catches
+}
 
-		switch stateType.Type {
-		case "Task":
-			var taskDef TaskStateDefinition
-			if err := json.Unmarshal(rawState, &taskDef); err != nil {
-				return nil, fmt.Errorf("could not unmarshal sub-task state '%s': %w", name, err)
-			}
-			taskDef.Name = name
-			task := &TaskState{name: taskDef.Name, next: taskDef.Next, end: taskDef.End, TimeoutSeconds: taskDef.TimeoutSeconds}
-			if taskFn, ok := tasks[name]; ok {
-				task.execute = taskFn
-			}
-			states[name] = task
-		case "Choice":
-			var choiceDef ChoiceStateDefinition
-			if err := json.Unmarshal(rawState, &choiceDef); err != nil {
-				return nil, fmt.Errorf("could not unmarshal sub-choice state '%s': %w", name, err)
-			}
-			choiceDef.Name = name
-			var choices []ChoiceRule
-			for _, rule := range choiceDef.Choices {
-				choices = append(choices, ChoiceRule{Condition: rule.Condition, Next: rule.Next})
-			}
-			states[name] = &ChoiceState{name: choiceDef.Name, choices: choices, defaultState: choiceDef.Default}
-		case "Wait":
-			var waitDef WaitStateDefinition
-			if err := json.Unmarshal(rawState, &waitDef); err != nil {
-				return nil, fmt.Errorf("could not unmarshal sub-wait state '%s': %w", name, err)
-			}
-			waitDef.Name = name
-			states[name] = &WaitState{name: waitDef.Name, seconds: waitDef.Seconds, next: waitDef.Next}
-		case "End":
-			states[name] = &EndState{name: name}
-		default:
-			return nil, fmt.Errorf("unknown sub-state type '%s' for state '%s'", stateType.Type, name)
+// timeout returns the fixed timeout of the task, from either
+// TimeoutSeconds or TimeoutMilliseconds.
+func (d TaskStateDefinition) timeout() (time.Duration, error) {
+	set := 0
+	for _, isSet := range []bool{d.TimeoutSeconds != 0, d.TimeoutMilliseconds != 0, d.TimeoutSecondsPath != ""} {
+		if isSet {
+			set++
 		}
 	}
-
-	return &StateMachine{
-		states:  states,
-		startAt: def.StartAt,
-	}, nil
+	if set > 1 {
+		return 0, fmt.Errorf("only one of TimeoutSeconds, TimeoutMilliseconds and TimeoutSecondsPath can be set")
+	}
+	if d.TimeoutMilliseconds != 0 {
+		return time.Duration(d.TimeoutMilliseconds) * time.Millisecond, nil
+	}
+	return secondsDuration(d.TimeoutSeconds), nil
 }
@@ -0,0 +1,190 @@
+package statemachine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// isRootPath reports whether path refers to the whole document.
+func isRootPath(path string) bool {
+	return path == "" || path == "$"
+}
+
+// compiledPaths caches compiled paths by expression, so that states do not
+// parse their paths again on every evaluation. Paths only come from state
+// machine definitions, which keeps the cache small.
+var compiledPaths sync.Map
+
+// cachedPath returns the compiled form of path, compiling it only once.
+func cachedPath(path string) (*jsonPath, error) {
+	if p, ok := compiledPaths.Load(path); ok {
+		return p.(*jsonPath), nil
+	}
+	p, err := compilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	compiledPaths.Store(path, p)
+	return p, nil
+}
+
+// getPath evaluates a JSONPath against data. Paths starting with "$$" are
+// evaluated against the context object of the execution running in ctx.
+func getPath(ctx context.Context, data any, path string) (any, error) {
+	p, err := cachedPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var contextObject any
+	if p.context {
+		contextObject = contextObjectFrom(ctx)
+	}
+	return p.evaluate(data, contextObject)
+}
+
+// compileReferencePath compiles a path that values can be written to.
+func compileReferencePath(path string) (*jsonPath, error) {
+	p, err := cachedPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if p.context || !p.definite() {
+		return nil, fmt.Errorf("invalid path '%s': only plain fields and indexes can be written", path)
+	}
+	return p, nil
+}
+
+// setPath writes value into data at a reference path, creating intermediate
+// objects as needed. Setting the root path replaces data entirely.
+func setPath(data map[string]any, path string, value any) (any, error) {
+	p, err := compileReferencePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.steps) == 0 {
+		return value, nil
+	}
+
+	var current any = data
+	for i, step := range p.steps {
+		last := i == len(p.steps)-1
+		switch step.kind {
+		case stepField:
+			obj, ok := current.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("path '%s': cannot set field '%s' on %s", path, step.field, typeName(current))
+			}
+			if last {
+				obj[step.field] = value
+				break
+			}
+			next, ok := obj[step.field]
+			if !ok || next == nil {
+				next = make(map[string]any)
+				obj[step.field] = next
+			}
+			current = next
+		case stepIndex:
+			arr, ok := current.([]any)
+			if !ok {
+				return nil, fmt.Errorf("path '%s': cannot index %s", path, typeName(current))
+			}
+			index := step.index
+			if index < 0 {
+				index += len(arr)
+			}
+			if index < 0 || index >= len(arr) {
+				return nil, fmt.Errorf("path '%s': index %d out of range for array of length %d", path, step.index, len(arr))
+			}
+			if last {
+				arr[index] = value
+				break
+			}
+			current = arr[index]
+		}
+	}
+	return data, nil
+}
+
+// applyTemplate builds a new object from a Parameters or ResultSelector
+// template. Keys ending in ".$" take their value from a path into input;
+// all other values are copied as they are.
+func applyTemplate(ctx context.Context, template map[string]any, input any) (map[string]any, error) {
+	out := make(map[string]any, len(template))
+	for key, value := range template {
+		if name, ok := strings.CutSuffix(key, ".$"); ok {
+			path, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("template field '%s' must be a path string, got %T", key, value)
+			}
+			resolved, err := getPath(ctx, input, path)
+			if err != nil {
+				return nil, fmt.Errorf("template field '%s': %w", key, err)
+			}
+			out[name] = copyValue(resolved)
+			continue
+		}
+		resolved, err := applyTemplateValue(ctx, value, input)
+		if err != nil {
+			return nil, fmt.Errorf("template field '%s': %w", key, err)
+		}
+		out[key] = resolved
+	}
+	return out, nil
+}
+
+// validateTemplate checks that every ".$" field of a template, at any depth,
+// holds a valid path.
+func validateTemplate(template map[string]any) error {
+	for key, value := range template {
+		if _, ok := strings.CutSuffix(key, ".$"); ok {
+			path, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("template field '%s' must be a path string, got %T", key, value)
+			}
+			if _, err := compilePath(path); err != nil {
+				return fmt.Errorf("template field '%s': %w", key, err)
+			}
+			continue
+		}
+		if err := validateTemplateValue(value); err != nil {
+			return fmt.Errorf("template field '%s': %w", key, err)
+		}
+	}
+	return nil
+}
+
+func validateTemplateValue(value any) error {
+	switch v := value.(type) {
+	case map[string]any:
+		return validateTemplate(v)
+	case []any:
+		for _, item := range v {
+			if err := validateTemplateValue(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyTemplateValue(ctx context.Context, value any, input any) (any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		return applyTemplate(ctx, v, input)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			resolved, err := applyTemplateValue(ctx, item, input)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	default:
+		return copyValue(v), nil
+	}
+}
@@ -11,6 +11,8 @@ import (
 type StateMachineDefinition struct {
 	StartAt string                     `json:"StartAt"`
 	States  map[string]json.RawMessage `json:"States"`
+	// TimeoutSeconds limits how long an execution may run. It may be fractional.
+	TimeoutSeconds float64 `json:"TimeoutSeconds,omitempty"`
 }
 
 // StateType is used to unmarshal the state's type.
@@ -20,47 +22,63 @@ type StateType struct {
 
 // State definition structs for JSON parsing
 type TaskStateDefinition struct {
-	Name           string            `json:"-"`
-	Type           string            `json:"Type"`
-	Next           string            `json:"Next,omitempty"`
-	End            bool              `json:"End,omitempty"`
-	Retry          []RetryDefinition `json:"Retry,omitempty"`
-	Catch          []CatchDefinition `json:"Catch,omitempty"`
-	TimeoutSeconds int               `json:"TimeoutSeconds,omitempty"`
+	Name  string            `json:"-"`
+	Type  string            `json:"Type"`
+	Next  string            `json:"Next,omitempty"`
+	End   bool              `json:"End,omitempty"`
+	Retry []RetryDefinition `json:"Retry,omitempty"`
+	Catch []CatchDefinition `json:"Catch,omitempty"`
+	// TimeoutSeconds and HeartbeatSeconds may be fractional. At most one of
+	// TimeoutSeconds, TimeoutMilliseconds and TimeoutSecondsPath can be set.
+	TimeoutSeconds      float64 `json:"TimeoutSeconds,omitempty"`
+	TimeoutMilliseconds int     `json:"TimeoutMilliseconds,omitempty"`
+	TimeoutSecondsPath  string  `json:"TimeoutSecondsPath,omitempty"`
+	HeartbeatSeconds    float64 `json:"HeartbeatSeconds,omitempty"`
+	DataFlow
 }
 
 type RetryDefinition struct {
-	ErrorEquals     []string `json:"ErrorEquals"`
-	IntervalSeconds int      `json:"IntervalSeconds"`
-	MaxAttempts     int      `json:"MaxAttempts"`
+	ErrorEquals     []string       `json:"ErrorEquals"`
+	IntervalSeconds int            `json:"IntervalSeconds"`
+	MaxAttempts     int            `json:"MaxAttempts"`
+	BackoffRate     float64        `json:"BackoffRate,omitempty"`
+	MaxDelaySeconds int            `json:"MaxDelaySeconds,omitempty"`
+	JitterStrategy  JitterStrategy `json:"JitterStrategy,omitempty"`
 }
 
 type CatchDefinition struct {
 	ErrorEquals []string `json:"ErrorEquals"`
 	Next        string   `json:"Next"`
+	ResultPath  string   `json:"ResultPath,omitempty"`
 }
 
 type PassStateDefinition struct {
 	Name string `json:"-"`
 	Type string `json:"Type"`
 	Next string `json:"Next"`
+	DataFlow
 }
 
 type ChoiceStateDefinition struct {
 	Name    string `json:"-"`
 	Type    string `json:"Type"`
 	Choices []struct {
+		Variable  string         `json:"Variable,omitempty"`
 		Condition map[string]any `json:"Condition"`
 		Next      string         `json:"Next"`
 	} `json:"Choices"`
 	Default string `json:"Default"`
+	DataFlow
 }
 
 type WaitStateDefinition struct {
-	Name    string `json:"-"`
-	Type    string `json:"Type"`
-	Seconds int    `json:"Seconds"`
-	Next    string `json:"Next"`
+	Name string `json:"-"`
+	Type string `json:"Type"`
+	// Seconds may be fractional. Milliseconds is used instead if set.
+	Seconds      float64 `json:"Seconds"`
+	Milliseconds int     `json:"Milliseconds,omitempty"`
+	Next         string  `json:"Next"`
+	DataFlow
 }
 
 type ParallelStateDefinition struct {
@@ -68,15 +86,30 @@ type ParallelStateDefinition struct {
 	Type     string                   `json:"Type"`
 	Branches []StateMachineDefinition `json:"Branches"`
 	Next     string                   `json:"Next"`
+	Catch    []CatchDefinition        `json:"Catch,omitempty"`
+	DataFlow
 }
 
 type MapStateDefinition struct {
-	Name       string                 `json:"-"`
-	Type       string                 `json:"Type"`
-	InputPath  string                 `json:"InputPath"`
-	ResultPath string                 `json:"ResultPath"`
-	Next       string                 `json:"Next"`
-	Iterator   StateMachineDefinition `json:"Iterator"`
+	Name      string                 `json:"-"`
+	Type      string                 `json:"Type"`
+	ItemsPath string                 `json:"ItemsPath,omitempty"`
+	Next      string                 `json:"Next"`
+	Iterator  StateMachineDefinition `json:"Iterator"`
+	Catch     []CatchDefinition      `json:"Catch,omitempty"`
+	// MaxConcurrency limits how many iterations run at the same time. Zero
+	// means no limit.
+	MaxConcurrency int `json:"MaxConcurrency,omitempty"`
+	// ToleratedFailureCount and ToleratedFailurePercentage let the state
+	// succeed with failed iterations, whose results are their error output.
+	ToleratedFailureCount      int     `json:"ToleratedFailureCount,omitempty"`
+	ToleratedFailurePercentage float64 `json:"ToleratedFailurePercentage,omitempty"`
+	// ItemSelector builds the input of each iteration. Parameters is accepted
+	// as its older name.
+	ItemSelector map[string]any `json:"ItemSelector,omitempty"`
+	// ItemReader reads the items from a file instead of ItemsPath.
+	ItemReader *ItemReader `json:"ItemReader,omitempty"`
+	DataFlow
 }
 
 // PassState simply passes its input to its output, optionally modifying it.
@@ -84,34 +117,92 @@ type PassState struct {
 	name     string
 	next     string
 	modifier func(sc *StateContext)
+	dataFlow DataFlow
 }
 
 func (s *PassState) GetName() string {
 	return s.name
 }
 
+func (s *PassState) validate() error {
+	if err := s.dataFlow.validate(); err != nil {
+		return fmt.Errorf("pass state '%s': %w", s.name, err)
+	}
+	return nil
+}
+
 func (s *PassState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("Executing PassState: %s\n", s.name)
+	input, err := s.dataFlow.effectiveInput(ctx, sc.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := input
 	if s.modifier != nil {
-		s.modifier(sc)
+		passSC, err := s.dataFlow.workingContext(sc, input)
+		if err != nil {
+			return nil, err
+		}
+		s.modifier(passSC)
+		result = passSC.Data
+	}
+
+	output, err := s.dataFlow.stateOutput(ctx, sc.Data, result)
+	if err != nil {
+		return nil, err
 	}
+	sc.Data = output
 	return machine.GetState(s.next), nil
 }
 
 // WaitState pauses the workflow for a specified duration.
 type WaitState struct {
-	name    string
-	seconds int
-	next    string
+	name     string
+	duration time.Duration
+	next     string
+	dataFlow DataFlow
 }
 
 func (s *WaitState) GetName() string {
 	return s.name
 }
 
+func (s *WaitState) validate() error {
+	if s.duration < 0 {
+		return fmt.Errorf("wait state '%s': duration must not be negative", s.name)
+	}
+	if err := s.dataFlow.validate(); err != nil {
+		return fmt.Errorf("wait state '%s': %w", s.name, err)
+	}
+	return nil
+}
+
 func (s *WaitState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("Executing WaitState: %s. Pausing for %d seconds...\n", s.name, s.seconds)
-	time.Sleep(time.Duration(s.seconds) * time.Second)
+	input, err := s.dataFlow.filterInput(ctx, sc.Data)
+	if err != nil {
+		return nil, err
+	}
+	// A resumed execution only waits for what was left of the wait.
+	wait := s.duration
+	if e := ExecutionFromContext(ctx); e != nil {
+		wait -= time.Since(e.stateEnteredTime())
+	}
+	LoggerFromContext(ctx).Debug("waiting", "duration", s.duration, "remaining", wait)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	output, err := s.dataFlow.filterOutput(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	sc.Data = output
 	return machine.GetState(s.next), nil
 }
 
@@ -125,7 +216,6 @@ func (s *FailState) GetName() string {
 }
 
 func (s *FailState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("State machine failed in state: %s\n", s.name)
 	return nil, fmt.Errorf("failure in state %s", s.name)
 }
 
@@ -139,6 +229,5 @@ func (s *EndState) GetName() string {
 }
 
 func (s *EndState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Println("Executing EndState...")
 	return nil, nil
 }
@@ -2,7 +2,6 @@ package statemachine
 
 import (
 	"context"
-	"fmt"
 	"time"
 )
 
@@ -21,12 +20,13 @@ type State interface {
 	GetName() string
 }
 
-// StateMachine manages the execution flow and holds all states.
+// StateMachine is an immutable workflow definition. It holds no per-run
+// state, so it can be started any number of times, concurrently.
 type StateMachine struct {
-	states       map[string]State
-	currentState State
-	Context      *StateContext
-	startAt      string
+	states  map[string]State
+	startAt string
+	// timeout limits how long an execution may run. Zero means no limit.
+	timeout time.Duration
 }
 
 // GetState retrieves a state by its name.
@@ -34,18 +34,36 @@ func (sm *StateMachine) GetState(name string) State {
 	return sm.states[name]
 }
 
-// Run executes the state machine.
-func (sm *StateMachine) Run(ctx context.Context, initialData map[string]any) error {
-	sm.Context = &StateContext{Data: initialData}
-	sm.currentState = sm.states[sm.startAt]
-
-	for sm.currentState != nil {
-		nextState, err := sm.currentState.Execute(ctx, sm.Context, sm)
-		if err != nil {
-			return fmt.Errorf("state '%s' failed: %w", sm.currentState.GetName(), err)
-		}
-		sm.currentState = nextState
-		time.Sleep(50 * time.Millisecond)
+// Start begins a new execution of the state machine in its own goroutine.
+// The input is copied, so the caller's map is never modified.
+func (sm *StateMachine) Start(ctx context.Context, input map[string]any, opts ...ExecutionOption) *Execution {
+	e := sm.newExecution(input, opts...)
+	go e.run(ctx)
+	return e
+}
+
+// newExecution returns an execution that is ready to run.
+func (sm *StateMachine) newExecution(input map[string]any, opts ...ExecutionOption) *Execution {
+	e := &Execution{
+		Input:     input,
+		StartTime: time.Now(),
+		machine:   sm,
+		context:   &StateContext{Data: copyData(input)},
+		done:      make(chan struct{}),
+		status:    ExecutionRunning,
+		logger:    discardLogger,
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
-	return nil
+	if e.ID == "" {
+		e.ID = newExecutionID()
+	}
+	return e
+}
+
+// Run executes the state machine and waits for the execution to stop.
+func (sm *StateMachine) Run(ctx context.Context, input map[string]any, opts ...ExecutionOption) (*Execution, error) {
+	e := sm.Start(ctx, input, opts...)
+	return e, e.Wait()
 }
@@ -0,0 +1,353 @@
+package statemachine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrCheckpointNotFound is returned by a Store when it has no checkpoint for an execution.
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// Checkpoint is the persisted progress of an execution. It is saved before
+// every state runs, after every failed task attempt that will be retried and
+// once more when the execution stops.
+type Checkpoint struct {
+	ExecutionID string          `json:"ExecutionId"`
+	Status      ExecutionStatus `json:"Status"`
+	Input       map[string]any  `json:"Input"`
+	StartTime   time.Time       `json:"StartTime"`
+	// StateName is the state to resume from, with the data it receives.
+	StateName        string         `json:"StateName"`
+	StateEnteredTime time.Time      `json:"StateEnteredTime"`
+	Data             map[string]any `json:"Data"`
+	// Attempts is the number of task attempts already made in StateName.
+	Attempts  int       `json:"Attempts"`
+	Error     string    `json:"Error,omitempty"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+}
+
+// Store persists checkpoints so executions can be resumed after the process
+// stops. Implementations must be safe for concurrent use. Checkpoints are
+// kept until they are deleted, also after the execution finished.
+type Store interface {
+	Save(ctx context.Context, checkpoint Checkpoint) error
+	Load(ctx context.Context, executionID string) (Checkpoint, error)
+	// Delete removes the checkpoint of an execution. Deleting a checkpoint
+	// that does not exist is not an error.
+	Delete(ctx context.Context, executionID string) error
+}
+
+// WithStore saves the progress of the execution to store, so it can be
+// continued with StateMachine.Resume. Data is saved as JSON, so numbers come
+// back as float64 after a resume.
+func WithStore(store Store) ExecutionOption {
+	return func(e *Execution) {
+		e.store = store
+	}
+}
+
+// Resume continues an execution from its last checkpoint in store. The
+// returned execution runs in its own goroutine, like one from Start.
+func (sm *StateMachine) Resume(ctx context.Context, store Store, executionID string, opts ...ExecutionOption) (*Execution, error) {
+	checkpoint, err := store.Load(ctx, executionID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load checkpoint for execution '%s': %w", executionID, err)
+	}
+	if checkpoint.Status != ExecutionRunning {
+		return nil, fmt.Errorf("execution '%s' already stopped with status %s", executionID, checkpoint.Status)
+	}
+	if sm.GetState(checkpoint.StateName) == nil {
+		return nil, fmt.Errorf("execution '%s' stopped in unknown state '%s'", executionID, checkpoint.StateName)
+	}
+
+	e := sm.newExecution(checkpoint.Input, append(opts, WithStore(store))...)
+	e.ID = checkpoint.ExecutionID
+	e.StartTime = checkpoint.StartTime
+	e.context = &StateContext{Data: checkpoint.Data}
+	if e.context.Data == nil {
+		e.context.Data = make(map[string]any)
+	}
+	e.resume = &checkpoint
+	go e.run(ctx)
+	return e, nil
+}
+
+// saveCheckpoint persists the progress of the execution, if it has a store.
+func (e *Execution) saveCheckpoint(ctx context.Context, status ExecutionStatus, stateName string, attempts int, stopErr error) error {
+	if e.store == nil {
+		return nil
+	}
+	e.mu.RLock()
+	entered := e.stateEntered
+	e.mu.RUnlock()
+
+	checkpoint := Checkpoint{
+		ExecutionID:      e.ID,
+		Status:           status,
+		Input:            e.Input,
+		StartTime:        e.StartTime,
+		StateName:        stateName,
+		StateEnteredTime: entered,
+		Data:             copyData(e.context.Data),
+		Attempts:         attempts,
+		UpdatedAt:        time.Now(),
+	}
+	if stopErr != nil {
+		checkpoint.Error = stopErr.Error()
+	}
+	if err := e.store.Save(ctx, checkpoint); err != nil {
+		return fmt.Errorf("could not save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// FileStore keeps one JSON file per execution in a directory. Files are
+// replaced atomically, so a crash never leaves a half-written checkpoint.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore that writes to dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create store directory: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(executionID string) string {
+	return filepath.Join(s.dir, url.PathEscape(executionID)+".json")
+}
+
+func (s *FileStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("could not marshal checkpoint: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.dir, ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(checkpoint.ExecutionID))
+}
+
+func (s *FileStore) Load(ctx context.Context, executionID string) (Checkpoint, error) {
+	data, err := os.ReadFile(s.path(executionID))
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, ErrCheckpointNotFound
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("could not unmarshal checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, executionID string) error {
+	if err := os.Remove(s.path(executionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// JournalStore is an embedded, single-file store. Every checkpoint is
+// appended to the file as a JSON line and synced to disk; the latest
+// checkpoint of each execution is kept in memory for reads. Delete appends a
+// record that removes a checkpoint, and Compact rewrites the file with only
+// the latest checkpoints.
+type JournalStore struct {
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	checkpoints map[string]Checkpoint
+}
+
+// journalRecord is a line of the journal: a checkpoint, or the deletion of
+// the checkpoint of ExecutionID.
+type journalRecord struct {
+	Checkpoint
+	Deleted bool `json:"Deleted,omitempty"`
+}
+
+// OpenJournalStore opens or creates the journal at path and replays it.
+// A corrupt last line, as left by a crash mid-write, is removed from the
+// file; a corrupt line anywhere else is an error.
+func OpenJournalStore(path string) (*JournalStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open journal: %w", err)
+	}
+	checkpoints, err := replayJournal(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read journal: %w", err)
+	}
+	return &JournalStore{path: path, file: file, checkpoints: checkpoints}, nil
+}
+
+// replayJournal reads the latest checkpoints from file and truncates it to
+// its last complete record.
+func replayJournal(file *os.File) (map[string]Checkpoint, error) {
+	checkpoints := make(map[string]Checkpoint)
+	reader := bufio.NewReader(file)
+	// valid is the end of the last complete record, and corrupt the line
+	// after it if that could not be read.
+	var offset, valid int64
+	var corrupt error
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return nil, readErr
+		}
+		if len(line) > 0 {
+			if corrupt != nil {
+				return nil, corrupt
+			}
+			offset += int64(len(line))
+			var record journalRecord
+			switch {
+			case len(bytes.TrimSpace(line)) == 0:
+				valid = offset
+			case line[len(line)-1] != '\n' || json.Unmarshal(line, &record) != nil:
+				corrupt = fmt.Errorf("corrupt record at offset %d", valid)
+			case record.Deleted:
+				delete(checkpoints, record.ExecutionID)
+				valid = offset
+			default:
+				checkpoints[record.ExecutionID] = record.Checkpoint
+				valid = offset
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if valid < offset {
+		if err := file.Truncate(valid); err != nil {
+			return nil, err
+		}
+	}
+	return checkpoints, nil
+}
+
+func (s *JournalStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(journalRecord{Checkpoint: checkpoint}); err != nil {
+		return err
+	}
+	s.checkpoints[checkpoint.ExecutionID] = checkpoint
+	return nil
+}
+
+func (s *JournalStore) Delete(ctx context.Context, executionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.checkpoints[executionID]; !ok {
+		return nil
+	}
+	if err := s.append(journalRecord{Checkpoint: Checkpoint{ExecutionID: executionID}, Deleted: true}); err != nil {
+		return err
+	}
+	delete(s.checkpoints, executionID)
+	return nil
+}
+
+// append writes record to the journal and syncs it to disk.
+func (s *JournalStore) append(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not marshal checkpoint: %w", err)
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *JournalStore) Load(ctx context.Context, executionID string) (Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoint, ok := s.checkpoints[executionID]
+	if !ok {
+		return Checkpoint{}, ErrCheckpointNotFound
+	}
+	return checkpoint, nil
+}
+
+// Compact rewrites the journal so it only holds the latest checkpoint of
+// each execution.
+func (s *JournalStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpPath := s.path + ".compact"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, checkpoint := range s.checkpoints {
+		data, err := json.Marshal(checkpoint)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+// Close closes the journal file.
+func (s *JournalStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -4,78 +4,264 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand/v2"
 	"time"
 )
 
 // TaskFn defines the signature for a function to be executed by a TaskState.
 type TaskFn func(ctx context.Context, sc *StateContext) error
 
-// RetryRule defines how to handle specific errors for retries.
+// JitterStrategy controls the randomisation of retry delays.
+type JitterStrategy string
+
+const (
+	// JitterNone waits exactly the computed delay.
+	JitterNone JitterStrategy = "NONE"
+	// JitterFull waits a random duration between zero and the computed delay,
+	// so that clients retrying the same failure do not retry in lockstep.
+	JitterFull JitterStrategy = "FULL"
+)
+
+// RetryRule defines how to handle specific errors for retries. The delay
+// before retry n (starting at 1) is Interval * BackoffRate^(n-1), capped at
+// MaxDelay and then randomised according to JitterStrategy.
 type RetryRule struct {
+	// ErrorName and ErrorEquals name the errors the rule applies to, Errors
+	// lists sentinel errors matched with errors.Is and Match is an arbitrary
+	// predicate. The rule applies if any of them matches.
 	ErrorName   string
+	ErrorEquals []string
+	Errors      []error
+	Match       func(error) bool
 	Interval    time.Duration
 	MaxAttempts int
+	// BackoffRate multiplies the delay after every retry. Zero means 1, a
+	// fixed interval.
+	BackoffRate float64
+	// MaxDelay caps the delay. Zero means no cap.
+	MaxDelay       time.Duration
+	JitterStrategy JitterStrategy
+}
+
+// delay returns how long to wait before retry n, starting at 1.
+func (r RetryRule) delay(n int) time.Duration {
+	rate := r.BackoffRate
+	if rate == 0 {
+		rate = 1
+	}
+	delay := float64(r.Interval) * math.Pow(rate, float64(n-1))
+	if r.MaxDelay > 0 && delay > float64(r.MaxDelay) {
+		delay = float64(r.MaxDelay)
+	}
+	if delay > math.MaxInt64 {
+		delay = math.MaxInt64
+	}
+	if r.JitterStrategy == JitterFull && delay > 0 {
+		delay = rand.Float64() * delay
+	}
+	return time.Duration(delay)
+}
+
+func (r RetryRule) matcher() errorMatcher {
+	return errorMatcher{names: ruleErrorNames(r.ErrorName, r.ErrorEquals), errors: r.Errors, matchFn: r.Match}
+}
+
+func (r RetryRule) validate() error {
+	if r.BackoffRate != 0 && r.BackoffRate < 1 {
+		return fmt.Errorf("retry rule for %v: BackoffRate must be at least 1, got %v", r.matcher().names, r.BackoffRate)
+	}
+	if r.Interval < 0 || r.MaxDelay < 0 {
+		return fmt.Errorf("retry rule for %v: Interval and MaxDelay must not be negative", r.matcher().names)
+	}
+	switch r.JitterStrategy {
+	case "", JitterNone, JitterFull:
+	default:
+		return fmt.Errorf("retry rule for %v: unknown JitterStrategy '%s'", r.matcher().names, r.JitterStrategy)
+	}
+	return nil
 }
 
 // CatchRule defines a transition for a caught error.
 type CatchRule struct {
-	ErrorName string
-	NextState string
+	// ErrorName and ErrorEquals name the errors the rule applies to, Errors
+	// lists sentinel errors matched with errors.Is and Match is an arbitrary
+	// predicate. The rule applies if any of them matches.
+	ErrorName   string
+	ErrorEquals []string
+	Errors      []error
+	Match       func(error) bool
+	NextState   string
+	// ResultPath is where the error output {"Error": name, "Cause": message}
+	// is written in the state's input before moving to NextState. If it is
+	// empty the data is left as it is.
+	ResultPath string
+}
+
+func (r CatchRule) matcher() errorMatcher {
+	return errorMatcher{names: ruleErrorNames(r.ErrorName, r.ErrorEquals), errors: r.Errors, matchFn: r.Match}
+}
+
+func validateCatches(catches []CatchRule) error {
+	for i, rule := range catches {
+		if err := rule.matcher().validate(i, len(catches)); err != nil {
+			return fmt.Errorf("catch %w", err)
+		}
+		if rule.ResultPath != "" {
+			if _, err := compileReferencePath(rule.ResultPath); err != nil {
+				return fmt.Errorf("catch rule %d: ResultPath: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// catchError moves to the NextState of the first catch rule that matches
+// err, after writing the error output at its ResultPath. It reports whether
+// a rule matched. Nothing is caught once ctx is done, whether the execution
+// timed out, was aborted or a failed sibling cancelled it, so that it stops
+// in the state that was running.
+func catchError(ctx context.Context, state State, catches []CatchRule, sc *StateContext, machine *StateMachine, err error) (State, bool, error) {
+	if ctx.Err() != nil {
+		return nil, false, nil
+	}
+	for _, catchRule := range catches {
+		name, ok := catchRule.matcher().match(err)
+		if !ok {
+			continue
+		}
+		if catchRule.ResultPath != "" {
+			output, pathErr := setPath(sc.Data, catchRule.ResultPath, errorOutput(err))
+			if pathErr != nil {
+				return nil, false, fmt.Errorf("catch ResultPath: %w", pathErr)
+			}
+			data, isObject := output.(map[string]any)
+			if !isObject {
+				return nil, false, fmt.Errorf("catch ResultPath: state output must be a JSON object, got %T", output)
+			}
+			sc.Data = data
+		}
+		LoggerFromContext(ctx).Info("error caught", "error_name", name, "next", catchRule.NextState)
+		emitStateEvent(ctx, state, Event{Type: EventErrorCaught, ErrorName: name, NextState: catchRule.NextState, Error: err})
+		return machine.GetState(catchRule.NextState), true, nil
+	}
+	return nil, false, nil
+}
+
+func ruleErrorNames(name string, equals []string) []string {
+	if name == "" {
+		return equals
+	}
+	return append([]string{name}, equals...)
 }
 
 // TaskState is a concrete state that runs a given function with retry and catch logic.
 type TaskState struct {
-	name           string
-	execute        TaskFn
-	next           string
-	retries        []RetryRule
-	catches        []CatchRule
-	end            bool
-	TimeoutSeconds int
+	name    string
+	execute TaskFn
+	next    string
+	retries []RetryRule
+	catches []CatchRule
+	end     bool
+	// timeout fails an attempt with States.Timeout once it has run this long.
+	timeout time.Duration
+	// heartbeat fails an attempt with States.HeartbeatTimeout if the task
+	// function does not call SendHeartbeat at least this often.
+	heartbeat time.Duration
+	// timeoutPath reads the timeout in seconds from the state input instead.
+	timeoutPath string
+	dataFlow    DataFlow
 }
 
 func (s *TaskState) GetName() string {
 	return s.name
 }
 
-func (s *TaskState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
-	fmt.Printf("Executing TaskState: %s\n", s.name)
-
-	var err error
-	for i := 0; ; i++ {
-		taskCtx := ctx
-		if s.TimeoutSeconds > 0 {
-			var cancel context.CancelFunc
-			taskCtx, cancel = context.WithTimeout(ctx, time.Duration(s.TimeoutSeconds)*time.Second)
-			defer cancel()
+func (s *TaskState) validate() error {
+	if s.timeout < 0 || s.heartbeat < 0 {
+		return fmt.Errorf("task state '%s': timeout and heartbeat must not be negative", s.name)
+	}
+	if s.heartbeat > 0 && s.timeout > 0 && s.heartbeat >= s.timeout {
+		return fmt.Errorf("task state '%s': heartbeat must be shorter than the timeout", s.name)
+	}
+	if err := s.dataFlow.validate(); err != nil {
+		return fmt.Errorf("task state '%s': %w", s.name, err)
+	}
+	if s.timeoutPath != "" {
+		if s.timeout > 0 {
+			return fmt.Errorf("task state '%s': a timeout and TimeoutSecondsPath cannot both be set", s.name)
+		}
+		if _, err := compilePath(s.timeoutPath); err != nil {
+			return fmt.Errorf("task state '%s': TimeoutSecondsPath: %w", s.name, err)
 		}
+	}
+	for i, rule := range s.retries {
+		if err := rule.matcher().validate(i, len(s.retries)); err != nil {
+			return fmt.Errorf("task state '%s': retry %w", s.name, err)
+		}
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("task state '%s': %w", s.name, err)
+		}
+	}
+	if err := validateCatches(s.catches); err != nil {
+		return fmt.Errorf("task state '%s': %w", s.name, err)
+	}
+	return nil
+}
 
-		// Channel to signal task completion
-		done := make(chan error, 1)
-		go func() {
-			done <- s.execute(taskCtx, sc)
-		}()
+func (s *TaskState) Execute(ctx context.Context, sc *StateContext, machine *StateMachine) (State, error) {
+	logger := LoggerFromContext(ctx)
+	input, err := s.dataFlow.effectiveInput(ctx, sc.Data)
+	if err != nil {
+		return nil, err
+	}
+	taskSC, err := s.dataFlow.workingContext(sc, input)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := s.attemptTimeout(ctx, input)
+	if err != nil {
+		return nil, err
+	}
 
-		select {
-		case taskErr := <-done:
-			err = taskErr
-		case <-taskCtx.Done():
-			err = ErrTimeout
-		}
+	first := 0
+	e := ExecutionFromContext(ctx)
+	if e != nil {
+		first = e.resumedAttempts()
+	}
+	for i := first; ; i++ {
+		emitStateEvent(ctx, s, Event{Type: EventTaskAttemptStarted, Attempt: i + 1})
+		started := time.Now()
+		err = s.runAttempt(ctx, taskSC, i+1, timeout)
 
 		if err == nil {
+			emitStateEvent(ctx, s, Event{Type: EventTaskAttemptSucceeded, Attempt: i + 1, Duration: time.Since(started)})
+			output, err := s.dataFlow.stateOutput(ctx, sc.Data, taskSC.Data)
+			if err != nil {
+				return nil, err
+			}
+			sc.Data = output
 			if s.end {
 				return &EndState{name: "End"}, nil
 			}
 			return machine.GetState(s.next), nil
 		}
 
-		fmt.Printf("Task '%s' failed, attempt %d. Error: %v\n", s.name, i+1, err)
+		logger.Warn("task attempt failed", "attempt", i+1, "error_name", errorName(err), "error", err)
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			logger.Error("task panicked", "panic", panicErr.Value, "stack", string(panicErr.Stack))
+		}
+		emitStateEvent(ctx, s, Event{Type: EventTaskAttemptFailed, Attempt: i + 1, ErrorName: errorName(err), Error: err, Duration: time.Since(started)})
+		if ctx.Err() != nil {
+			// The execution timed out or was cancelled; it stops in this
+			// state without retrying.
+			return nil, err
+		}
 
 		var matchedRetryRule *RetryRule
 		for _, rule := range s.retries {
-			var customErr *CustomError
-			if errors.As(err, &customErr) && customErr.Name == rule.ErrorName {
+			if _, ok := rule.matcher().match(err); ok {
 				matchedRetryRule = &rule
 				break
 			}
@@ -84,16 +270,147 @@ func (s *TaskState) Execute(ctx context.Context, sc *StateContext, machine *Stat
 		if matchedRetryRule == nil || i >= matchedRetryRule.MaxAttempts {
 			break
 		}
-		time.Sleep(matchedRetryRule.Interval)
+		delay := matchedRetryRule.delay(i + 1)
+		logger.Debug("retry scheduled", "attempt", i+2, "delay", delay)
+		emitStateEvent(ctx, s, Event{Type: EventRetryScheduled, Attempt: i + 2, RetryDelay: delay, Error: err})
+		if e != nil {
+			if err := e.saveCheckpoint(ctx, ExecutionRunning, s.name, i+1, nil); err != nil {
+				return nil, err
+			}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+
+	if next, caught, catchErr := catchError(ctx, s, s.catches, sc, machine, err); caught || catchErr != nil {
+		return next, catchErr
+	}
+	return nil, err
+}
+
+// attemptTimeout returns the timeout of each attempt, reading it from the
+// effective input if the state has a TimeoutSecondsPath.
+func (s *TaskState) attemptTimeout(ctx context.Context, input any) (time.Duration, error) {
+	if s.timeoutPath == "" {
+		return s.timeout, nil
+	}
+	value, err := getPath(ctx, input, s.timeoutPath)
+	if err != nil {
+		return 0, fmt.Errorf("TimeoutSecondsPath: %w", err)
+	}
+	seconds, ok := toFloat(value)
+	if !ok || seconds <= 0 {
+		return 0, fmt.Errorf("TimeoutSecondsPath: timeout must be a positive number, got %v", value)
 	}
+	return secondsDuration(seconds), nil
+}
+
+// secondsDuration converts a possibly fractional number of seconds to a duration.
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// runAttempt runs the task function on a copy of taskSC, which replaces
+// taskSC.Data once the function returns. If the attempt times out, misses a
+// heartbeat or the execution is cancelled first, the function is abandoned:
+// its context is cancelled and its writes are discarded, while it keeps
+// running in the background until it returns. The copy is deep, as described
+// for Cloner; values it has to share remain visible to an abandoned function.
+func (s *TaskState) runAttempt(ctx context.Context, taskSC *StateContext, attempt int, timeout time.Duration) error {
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		taskCtx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		taskCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	// Heartbeats reset the heartbeat timer. Without HeartbeatSeconds its
+	// channel is never selected.
+	beats := make(chan struct{}, 1)
+	interval := s.heartbeat
+	heartbeat := time.NewTimer(interval)
+	defer heartbeat.Stop()
+	var heartbeatTimeout <-chan time.Time
+	if interval > 0 {
+		heartbeatTimeout = heartbeat.C
+		taskCtx = context.WithValue(taskCtx, heartbeatKey{}, beats)
+	}
+
+	attemptSC := &StateContext{Data: copyData(taskSC.Data)}
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer recoverPanic(&err)
+		err = s.execute(taskCtx, attemptSC)
+	}()
 
-	for _, catchRule := range s.catches {
-		var customErr *CustomError
-		if errors.As(err, &customErr) && customErr.Name == catchRule.ErrorName {
-			fmt.Printf("Error '%s' caught. Transitioning to state: %s\n", catchRule.ErrorName, catchRule.NextState)
-			return machine.GetState(catchRule.NextState), nil
+	var err error
+wait:
+	for {
+		select {
+		case err := <-done:
+			taskSC.Data = attemptSC.Data
+			return err
+		case <-beats:
+			heartbeat.Reset(interval)
+		case <-heartbeatTimeout:
+			err = ErrHeartbeatTimeout
+			break wait
+		case <-taskCtx.Done():
+			err = ErrTimeout
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			break wait
 		}
 	}
 
-	return nil, err
+	cancel()
+	s.abandon(ctx, attempt, done)
+	return err
+}
+
+type heartbeatKey struct{}
+
+// SendHeartbeat tells the task state running the calling task function that
+// it is still making progress. It must be called with the context passed to
+// the task function, and does nothing if the task has no HeartbeatSeconds.
+func SendHeartbeat(ctx context.Context) {
+	beats, ok := ctx.Value(heartbeatKey{}).(chan struct{})
+	if !ok {
+		return
+	}
+	select {
+	case beats <- struct{}{}:
+	default:
+	}
+}
+
+// abandon tracks a task attempt that is still running after it timed out,
+// until its function returns.
+func (s *TaskState) abandon(ctx context.Context, attempt int, done <-chan error) {
+	logger := LoggerFromContext(ctx)
+	logger.Warn("task attempt abandoned", "attempt", attempt)
+	emitStateEvent(ctx, s, Event{Type: EventTaskAttemptAbandoned, Attempt: attempt})
+
+	e := ExecutionFromContext(ctx)
+	if e != nil {
+		e.abandoned.Add(1)
+	}
+	abandoned := time.Now()
+	go func() {
+		err := <-done
+		if e != nil {
+			e.abandoned.Add(-1)
+		}
+		logger.Warn("abandoned task attempt returned", "attempt", attempt, "after", time.Since(abandoned), "error", err)
+	}()
 }